@@ -0,0 +1,99 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"go-starter-kit/internal/log"
+	"go-starter-kit/internal/pkg/database"
+	"go-starter-kit/internal/pkg/migrate"
+	"go-starter-kit/internal/server/config"
+	"go-starter-kit/migrations"
+	"os"
+	"os/signal"
+	"strconv"
+	"syscall"
+	"text/tabwriter"
+)
+
+const usage = `usage: migrate <command> [n]
+
+commands:
+  up [n]    apply n pending migrations, all when n is omitted
+  down [n]  revert the last n applied migrations, one when n is omitted
+  status    list migrations and whether they are applied
+  redo      revert and re-apply the last applied migration`
+
+func main() {
+	if len(os.Args) < 2 {
+		fmt.Fprintln(os.Stderr, usage)
+		os.Exit(2)
+	}
+	steps := 0
+	if len(os.Args) > 2 {
+		n, err := strconv.Atoi(os.Args[2])
+		if err != nil || n < 0 {
+			fmt.Fprintf(os.Stderr, "invalid step count %q\n\n%s\n", os.Args[2], usage)
+			os.Exit(2)
+		}
+		steps = n
+	}
+
+	conf, err := config.NewConfig()
+	if err != nil {
+		panic("init config failed: " + err.Error())
+	}
+	logger, err := log.NewLogger(conf)
+	if err != nil {
+		panic("init logger failed: " + err.Error())
+	}
+
+	db, err := database.Open("master", conf.Connection.Postgresql.Master)
+	if err != nil {
+		logger.Fatalf("database:Open: connect master failed: %s", err)
+	}
+	defer db.Close()
+
+	migrator, err := migrate.NewMigrator(db, logger, migrations.FS)
+	if err != nil {
+		logger.Fatalf("migrate:NewMigrator: %s", err)
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	switch os.Args[1] {
+	case "up":
+		err = migrator.Up(ctx, steps)
+	case "down":
+		err = migrator.Down(ctx, steps)
+	case "redo":
+		err = migrator.Redo(ctx)
+	case "status":
+		err = printStatus(ctx, migrator)
+	default:
+		fmt.Fprintf(os.Stderr, "unknown command %q\n\n%s\n", os.Args[1], usage)
+		os.Exit(2)
+	}
+	if err != nil {
+		logger.Errorf("%s failed: %s", os.Args[1], err)
+		os.Exit(1)
+	}
+}
+
+func printStatus(ctx context.Context, migrator *migrate.Migrator) error {
+	statuses, err := migrator.Status(ctx)
+	if err != nil {
+		return err
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "VERSION\tNAME\tSTATE\tAPPLIED AT")
+	for _, s := range statuses {
+		appliedAt := "-"
+		if s.AppliedAt != nil {
+			appliedAt = s.AppliedAt.Format("2006-01-02 15:04:05 MST")
+		}
+		fmt.Fprintf(w, "%d\t%s\t%s\t%s\n", s.Version, s.Name, s.State, appliedAt)
+	}
+	return w.Flush()
+}
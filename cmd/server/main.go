@@ -2,8 +2,10 @@ package main
 
 import (
 	"fmt"
+	"github.com/prometheus/client_golang/prometheus"
 	"go-starter-kit/internal/log"
 	"go-starter-kit/internal/pkg/database"
+	"go-starter-kit/internal/pkg/outbox"
 	"go-starter-kit/internal/server"
 	"go-starter-kit/internal/server/config"
 )
@@ -22,10 +24,22 @@ func main() {
 	if err != nil {
 		logger.Fatal("database:NewPostgres: init failed: %s", err)
 	}
+	queryMetrics, err := database.NewPrometheusHook(prometheus.DefaultRegisterer)
+	if err != nil {
+		logger.Fatalf("database:NewPrometheusHook: init failed: %s", err)
+	}
+	postgres.AddQueryHook(queryMetrics)
 
-	httpClient := server.NewHTTPServer(logger, conf)
+	// Pass jwt.NewValidator(secret, sessionChecker) to authenticate requests;
+	// tenancy and session variables take the claims from it.
+	httpClient := server.NewHTTPServer(logger, conf, nil)
+
+	var relay *outbox.Relay
+	if conf.Outbox.Enabled {
+		relay = outbox.NewRelay(conf, logger, postgres, outbox.NewLogPublisher(logger))
+	}
 
-	srv := server.NewServer(conf, logger, httpClient, postgres)
+	srv := server.NewServer(conf, logger, httpClient, postgres, relay)
 
 	go func() {
 		defer func() {
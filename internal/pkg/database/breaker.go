@@ -0,0 +1,214 @@
+package database
+
+import (
+	"context"
+	"database/sql/driver"
+	"errors"
+	"github.com/jackc/pgconn"
+	"go-starter-kit/internal/log"
+	"io"
+	"net"
+	"strings"
+	"sync"
+	"time"
+)
+
+type BreakerState string
+
+const (
+	BreakerClosed   BreakerState = "closed"
+	BreakerOpen     BreakerState = "open"
+	BreakerHalfOpen BreakerState = "half_open"
+)
+
+const (
+	defaultBreakerOpenTimeout      = 5 * time.Second
+	defaultBreakerHalfOpenRequests = 1
+)
+
+// ErrCircuitOpen is returned instead of a connection while the breaker of the
+// only pool that could serve the call is open.
+var ErrCircuitOpen = errors.New("postgres circuit breaker open")
+
+type breakerConfig struct {
+	failureThreshold int
+	openTimeout      time.Duration
+	halfOpenRequests int
+}
+
+// breaker is a circuit breaker for one pool. After failureThreshold
+// consecutive failed queries it opens and the pool is skipped. After
+// openTimeout it turns half-open and lets halfOpenRequests calls through as
+// probes: if they all succeed it closes, if one fails it opens again.
+//
+// A nil *breaker is always closed, which is what a zero failureThreshold in
+// the config gives.
+type breaker struct {
+	name   string
+	logger log.Logger
+	conf   breakerConfig
+
+	mu        sync.Mutex
+	state     BreakerState
+	changedAt time.Time
+	failures  int
+	probes    int
+	successes int
+}
+
+func newBreaker(name string, logger log.Logger, conf breakerConfig) *breaker {
+	if conf.failureThreshold <= 0 {
+		return nil
+	}
+	if conf.openTimeout <= 0 {
+		conf.openTimeout = defaultBreakerOpenTimeout
+	}
+	if conf.halfOpenRequests <= 0 {
+		conf.halfOpenRequests = defaultBreakerHalfOpenRequests
+	}
+	return &breaker{
+		name:      name,
+		logger:    logger,
+		conf:      conf,
+		state:     BreakerClosed,
+		changedAt: time.Now(),
+	}
+}
+
+func (b *breaker) State() BreakerState {
+	if b == nil {
+		return BreakerClosed
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.state
+}
+
+// ready reports whether allow would let a call through, without using up a
+// half-open probe. The balancer filters on it before picking a replica.
+func (b *breaker) ready() bool {
+	if b == nil {
+		return true
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	switch b.state {
+	case BreakerOpen:
+		return time.Since(b.changedAt) >= b.conf.openTimeout
+	case BreakerHalfOpen:
+		return b.probes < b.conf.halfOpenRequests || time.Since(b.changedAt) >= b.conf.openTimeout
+	default:
+		return true
+	}
+}
+
+func (b *breaker) allow() bool {
+	if b == nil {
+		return true
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	switch b.state {
+	case BreakerOpen:
+		if time.Since(b.changedAt) < b.conf.openTimeout {
+			return false
+		}
+		b.setState(BreakerHalfOpen)
+	case BreakerHalfOpen:
+		if b.probes >= b.conf.halfOpenRequests {
+			// Probes whose connection never ran a query report nothing;
+			// hand out new ones rather than stay half-open for good.
+			if time.Since(b.changedAt) < b.conf.openTimeout {
+				return false
+			}
+			b.changedAt = time.Now()
+			b.probes, b.successes = 0, 0
+		}
+	default:
+		return true
+	}
+	b.probes++
+	return true
+}
+
+// record feeds the outcome of one query run with ctx to the breaker. Errors
+// that say nothing about the health of the pool, like constraint violations,
+// lock conflicts or a request out of time, do not count either way.
+func (b *breaker) record(ctx context.Context, err error) {
+	if b == nil {
+		return
+	}
+	failure := isPoolFailure(ctx, err)
+	if err != nil && !failure {
+		return
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	switch b.state {
+	case BreakerClosed:
+		if !failure {
+			b.failures = 0
+			return
+		}
+		b.failures++
+		if b.failures >= b.conf.failureThreshold {
+			b.logger.Warnf("postgres %s: circuit breaker open after %d consecutive failures: %s",
+				b.name, b.failures, err)
+			b.setState(BreakerOpen)
+		}
+	case BreakerHalfOpen:
+		if failure {
+			b.logger.Warnf("postgres %s: circuit breaker probe failed, open again: %s", b.name, err)
+			b.setState(BreakerOpen)
+			return
+		}
+		b.successes++
+		if b.successes >= b.conf.halfOpenRequests {
+			b.logger.Infof("postgres %s: circuit breaker closed", b.name)
+			b.setState(BreakerClosed)
+		}
+	}
+}
+
+// setState moves to state and resets the counters. Callers hold b.mu.
+func (b *breaker) setState(state BreakerState) {
+	b.state = state
+	b.changedAt = time.Now()
+	b.failures, b.probes, b.successes = 0, 0, 0
+}
+
+// isPoolFailure reports whether err, returned by a query run with ctx, means
+// the pool could not serve it: lost or refused connections and a server
+// refusing work. Statement and lock timeouts are the query's own doing, and
+// once ctx is done its deadline or cancellation explains any error, so none
+// of them count. A deadline hit while ctx is still live, like a connect
+// timeout, does.
+func isPoolFailure(ctx context.Context, err error) bool {
+	if err == nil || ctx.Err() != nil || errors.Is(err, context.Canceled) {
+		return false
+	}
+	var pgErr *pgconn.PgError
+	if errors.As(err, &pgErr) {
+		switch {
+		case strings.HasPrefix(pgErr.Code, "08"), // connection_exception
+			strings.HasPrefix(pgErr.Code, "53"): // insufficient_resources, e.g. too_many_connections
+			return true
+		}
+		switch pgErr.Code {
+		case "57P01", // admin_shutdown
+			"57P02", // crash_shutdown
+			"57P03": // cannot_connect_now
+			return true
+		}
+		return false
+	}
+	if errors.Is(err, context.DeadlineExceeded) || pgconn.Timeout(err) {
+		return true
+	}
+	var netErr net.Error
+	return errors.As(err, &netErr) ||
+		errors.Is(err, driver.ErrBadConn) ||
+		errors.Is(err, io.EOF) ||
+		errors.Is(err, io.ErrUnexpectedEOF)
+}
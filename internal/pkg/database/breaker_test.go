@@ -0,0 +1,174 @@
+package database
+
+import (
+	"context"
+	"database/sql/driver"
+	"errors"
+	"fmt"
+	"github.com/jackc/pgconn"
+	"go-starter-kit/internal/log"
+	"go-starter-kit/internal/server/config"
+	"io"
+	"testing"
+	"time"
+)
+
+func newTestLogger(t *testing.T) log.Logger {
+	t.Helper()
+	cfg := &config.Config{}
+	cfg.Log.Core = "logrus"
+	cfg.Log.Level = "error"
+	cfg.Log.Output = "discard"
+	logger, err := log.NewLogger(cfg)
+	if err != nil {
+		t.Fatalf("new logger: %s", err)
+	}
+	return logger
+}
+
+// expire pretends openTimeout has passed since the last state change.
+func expire(b *breaker) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.changedAt = time.Now().Add(-b.conf.openTimeout)
+}
+
+func TestBreakerDisabled(t *testing.T) {
+	b := newBreaker("master", newTestLogger(t), breakerConfig{})
+	if b != nil {
+		t.Fatal("zero failureThreshold gives a breaker, want nil")
+	}
+	ctx := context.Background()
+	for i := 0; i < 10; i++ {
+		b.record(ctx, io.EOF)
+	}
+	if !b.allow() || !b.ready() || b.State() != BreakerClosed {
+		t.Error("nil breaker is not always closed")
+	}
+}
+
+func TestBreakerTransitions(t *testing.T) {
+	b := newBreaker("replica-0", newTestLogger(t), breakerConfig{
+		failureThreshold: 3,
+		openTimeout:      time.Minute,
+		halfOpenRequests: 2,
+	})
+	ctx := context.Background()
+	failure := &pgconn.PgError{Code: "08006"} // connection_failure
+	state := func(want BreakerState) {
+		t.Helper()
+		if got := b.State(); got != want {
+			t.Fatalf("state = %s, want %s", got, want)
+		}
+	}
+
+	// Only consecutive failures open it.
+	b.record(ctx, failure)
+	b.record(ctx, failure)
+	b.record(ctx, nil)
+	b.record(ctx, failure)
+	b.record(ctx, failure)
+	state(BreakerClosed)
+	// Errors that say nothing about the pool neither count nor reset.
+	b.record(ctx, &pgconn.PgError{Code: "23505"})
+	b.record(ctx, context.Canceled)
+	// Neither do lock conflicts and statement timeouts, however many.
+	for i := 0; i < 5; i++ {
+		b.record(ctx, &pgconn.PgError{Code: "55P03"})
+		b.record(ctx, &pgconn.PgError{Code: "57014"})
+	}
+	state(BreakerClosed)
+	b.record(ctx, failure)
+	state(BreakerOpen)
+	if b.ready() || b.allow() {
+		t.Fatal("open breaker lets calls through before openTimeout")
+	}
+
+	// After openTimeout it hands out halfOpenRequests probes.
+	expire(b)
+	if !b.ready() {
+		t.Fatal("open breaker not ready after openTimeout")
+	}
+	if !b.allow() || !b.allow() {
+		t.Fatal("half-open breaker refused a probe")
+	}
+	state(BreakerHalfOpen)
+	if b.ready() || b.allow() {
+		t.Fatal("half-open breaker lets more than halfOpenRequests probes through")
+	}
+
+	// A failed probe opens it again.
+	b.record(ctx, failure)
+	state(BreakerOpen)
+
+	// Successful probes close it.
+	expire(b)
+	b.allow()
+	b.allow()
+	b.record(ctx, nil)
+	state(BreakerHalfOpen)
+	b.record(ctx, nil)
+	state(BreakerClosed)
+	if !b.allow() {
+		t.Fatal("closed breaker refused a call")
+	}
+}
+
+// TestBreakerLostProbes checks that probes that never report back do not
+// keep the breaker half-open for good.
+func TestBreakerLostProbes(t *testing.T) {
+	b := newBreaker("replica-0", newTestLogger(t), breakerConfig{failureThreshold: 1, openTimeout: time.Minute})
+	b.record(context.Background(), io.EOF)
+	expire(b)
+	if !b.allow() {
+		t.Fatal("no probe after openTimeout")
+	}
+	if b.allow() {
+		t.Fatal("second probe handed out right away")
+	}
+	expire(b)
+	if !b.allow() {
+		t.Fatal("no new probe after the first one got lost")
+	}
+	if got := b.State(); got != BreakerHalfOpen {
+		t.Errorf("state = %s, want %s", got, BreakerHalfOpen)
+	}
+}
+
+func TestIsPoolFailure(t *testing.T) {
+	done, cancel := context.WithCancel(context.Background())
+	cancel()
+	tests := []struct {
+		name string
+		ctx  context.Context
+		err  error
+		want bool
+	}{
+		{name: "success", err: nil, want: false},
+		{name: "cancelled", err: context.Canceled, want: false},
+		{name: "other error", err: errors.New("boom"), want: false},
+		{name: "unique violation", err: &pgconn.PgError{Code: "23505"}, want: false},
+		{name: "undefined table", err: &pgconn.PgError{Code: "42P01"}, want: false},
+		{name: "lock not available", err: &pgconn.PgError{Code: "55P03"}, want: false},
+		{name: "statement timeout", err: &pgconn.PgError{Code: "57014"}, want: false},
+		{name: "connection failure", err: &pgconn.PgError{Code: "08006"}, want: true},
+		{name: "too many connections", err: &pgconn.PgError{Code: "53300"}, want: true},
+		{name: "admin shutdown", err: &pgconn.PgError{Code: "57P01"}, want: true},
+		{name: "cannot connect now", err: &pgconn.PgError{Code: "57P03"}, want: true},
+		{name: "connect timeout", err: fmt.Errorf("connect: %w", context.DeadlineExceeded), want: true},
+		{name: "caller deadline", ctx: done, err: context.DeadlineExceeded, want: false},
+		{name: "lost connection after cancel", ctx: done, err: io.ErrUnexpectedEOF, want: false},
+		{name: "bad conn", err: fmt.Errorf("query: %w", driver.ErrBadConn), want: true},
+		{name: "eof", err: io.EOF, want: true},
+		{name: "unexpected eof", err: io.ErrUnexpectedEOF, want: true},
+	}
+	for _, tt := range tests {
+		ctx := tt.ctx
+		if ctx == nil {
+			ctx = context.Background()
+		}
+		if got := isPoolFailure(ctx, tt.err); got != tt.want {
+			t.Errorf("%s: isPoolFailure(%v) = %v, want %v", tt.name, tt.err, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,137 @@
+package database
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/jackc/pgx/v4"
+	"strconv"
+	"strings"
+)
+
+const (
+	defaultBulkBatchSize = 1000
+	// maxBindParams is the Postgres limit on parameters in one statement.
+	maxBindParams = 65535
+)
+
+// RowSource feeds rows to BulkInsert. It is pgx.CopyFromSource, so
+// pgx.CopyFromRows and pgx.CopyFromSlice can be used directly.
+type RowSource = pgx.CopyFromSource
+
+// BulkInsert writes every row of rows into table using COPY FROM STDIN. When
+// the connection cannot COPY it falls back to multi-row INSERT statements.
+// Either way it joins the request transaction when ctx carries one and is
+// atomic on its own otherwise. table may be schema qualified.
+func (p *Postgres) BulkInsert(ctx context.Context, table string, columns []string, rows RowSource) (int64, error) {
+	if len(columns) == 0 {
+		return 0, errors.New("bulk insert: no columns")
+	}
+	identifier := pgx.Identifier(strings.Split(table, "."))
+
+	var copied int64
+	err := p.WithNativeWriteConnection(ctx, func(conn NativeConn) error {
+		n, err := conn.CopyFrom(ctx, identifier, columns, rows)
+		copied = n
+		return err
+	})
+	if !errors.Is(err, ErrNativeUnsupported) {
+		if err != nil {
+			return copied, fmt.Errorf("bulk insert: copy into %s failed: %w", table, err)
+		}
+		return copied, nil
+	}
+
+	// rows can only be read once, so unlike RunInTx nothing is retried.
+	txCtx, err := p.Begin(ctx)
+	if err != nil {
+		return 0, err
+	}
+	conn, err := p.GetWriteConnection(txCtx)
+	if err != nil {
+		_ = p.EndCtx(txCtx, err)
+		return 0, err
+	}
+	inserted, err := insertBatches(ctx, conn, identifier, columns, rows)
+	if endErr := p.EndCtx(txCtx, err); err == nil {
+		err = endErr
+	}
+	if err != nil {
+		return inserted, fmt.Errorf("bulk insert: insert into %s failed: %w", table, err)
+	}
+	return inserted, nil
+}
+
+func insertBatches(ctx context.Context, conn Conn, table pgx.Identifier, columns []string, rows RowSource) (int64, error) {
+	quoted := make([]string, len(columns))
+	for i, column := range columns {
+		quoted[i] = pgx.Identifier{column}.Sanitize()
+	}
+	prefix := fmt.Sprintf("INSERT INTO %s (%s) VALUES ", table.Sanitize(), strings.Join(quoted, ", "))
+
+	batchSize := defaultBulkBatchSize
+	if limit := maxBindParams / len(columns); batchSize > limit {
+		batchSize = limit
+	}
+
+	var total int64
+	args := make([]interface{}, 0, batchSize*len(columns))
+	flush := func() error {
+		if len(args) == 0 {
+			return nil
+		}
+		result, err := conn.ExecContext(ctx, prefix+valuesPlaceholders(len(args)/len(columns), len(columns)), args...)
+		if err != nil {
+			return err
+		}
+		n, err := result.RowsAffected()
+		if err != nil {
+			return err
+		}
+		total += n
+		args = args[:0]
+		return nil
+	}
+
+	for rows.Next() {
+		values, err := rows.Values()
+		if err != nil {
+			return total, err
+		}
+		if len(values) != len(columns) {
+			return total, fmt.Errorf("row has %d values, want %d", len(values), len(columns))
+		}
+		args = append(args, values...)
+		if len(args) == batchSize*len(columns) {
+			if err := flush(); err != nil {
+				return total, err
+			}
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return total, err
+	}
+	return total, flush()
+}
+
+// valuesPlaceholders renders ($1, $2), ($3, $4), ... for rows of width columns.
+func valuesPlaceholders(rows, width int) string {
+	var b strings.Builder
+	n := 1
+	for r := 0; r < rows; r++ {
+		if r > 0 {
+			b.WriteString(", ")
+		}
+		b.WriteByte('(')
+		for c := 0; c < width; c++ {
+			if c > 0 {
+				b.WriteString(", ")
+			}
+			b.WriteByte('$')
+			b.WriteString(strconv.Itoa(n))
+			n++
+		}
+		b.WriteByte(')')
+	}
+	return b.String()
+}
@@ -0,0 +1,20 @@
+package database
+
+import "testing"
+
+func TestValuesPlaceholders(t *testing.T) {
+	tests := []struct {
+		rows, width int
+		want        string
+	}{
+		{rows: 0, width: 3, want: ""},
+		{rows: 1, width: 1, want: "($1)"},
+		{rows: 1, width: 3, want: "($1, $2, $3)"},
+		{rows: 3, width: 2, want: "($1, $2), ($3, $4), ($5, $6)"},
+	}
+	for _, tt := range tests {
+		if got := valuesPlaceholders(tt.rows, tt.width); got != tt.want {
+			t.Errorf("valuesPlaceholders(%d, %d) = %q, want %q", tt.rows, tt.width, got, tt.want)
+		}
+	}
+}
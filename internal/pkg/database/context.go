@@ -1,35 +1,526 @@
 package database
 
 import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
 	"github.com/jmoiron/sqlx"
 	"sync"
+	"sync/atomic"
 )
 
+var (
+	ErrNoTransactionCtx = errors.New("TransactionCtx Not found")
+	ErrTxAlreadyStarted = errors.New("transaction already started")
+	ErrTxEnded          = errors.New("transaction already ended")
+	// ErrSavepointNotInnermost is returned when a nested TransactionCtx ends
+	// while a savepoint opened after its own is still open. Releasing or
+	// rolling back to a savepoint destroys every later one, so nested
+	// contexts must end in reverse order of Begin.
+	ErrSavepointNotInnermost = errors.New("savepoint is not the innermost one")
+)
+
+// TxOptions extends sql.TxOptions with DEFERRABLE, which database/sql has no
+// notion of. Deferrable only has an effect on SERIALIZABLE READ ONLY
+// transactions.
+type TxOptions struct {
+	Isolation  sql.IsolationLevel
+	ReadOnly   bool
+	Deferrable bool
+}
+
 type TransactionCtx struct {
-	Mu   sync.Mutex
-	Conn *sqlx.Tx
+	Mu      sync.Mutex
+	Conn    *sqlx.Tx
+	Options *TxOptions
+
+	committed bool
+	// wrote is set on the root once a write connection was handed out for
+	// the transaction. Only then does its commit make it Committed.
+	wrote bool
+	// ended is set once End, Commit or Rollback ran, whether or not a
+	// transaction had been opened. An ended TransactionCtx never opens
+	// another one: nothing would end it, e.g. for writes made after the
+	// response was sent, so they fail with ErrTxEnded instead of being
+	// silently rolled back later.
+	ended   bool
+	sqlConn *sqlx.Conn
+
+	// parent and savepoint are set on a nested TransactionCtx, which shares
+	// its parent's *sqlx.Tx and only commits or rolls back its savepoint.
+	parent    *TransactionCtx
+	savepoint string
+	// savepoints numbers the savepoints of a root TransactionCtx and
+	// openSavepoints holds the nested contexts whose savepoint is open,
+	// innermost last. savepointsMu guards it and is taken after any Mu.
+	savepoints     atomic.Uint64
+	savepointsMu   sync.Mutex
+	openSavepoints []*TransactionCtx
+
+	// readTx is the read-only transaction that reads needing session
+	// settings share until End, on readConn to readReplica, or master when
+	// that is nil. See beginRead.
+	readTx      *sqlx.Tx
+	readConn    *sqlx.Conn
+	readReplica *replica
+
+	// tenantRefs holds, by tenant id, the release of each tenant pool a root
+	// TransactionCtx keeps open until End. See tenantRegistry.get.
+	tenantRefs map[string]func()
+
+	onCommit   []func(ctx context.Context)
+	onRollback []func(ctx context.Context, err error)
+}
+
+// OnCommit registers fn to run once the transaction has committed, e.g. to
+// publish events or invalidate caches. Hooks registered on a nested
+// transaction wait for the outermost commit.
+func (t *TransactionCtx) OnCommit(fn func(ctx context.Context)) {
+	t.Mu.Lock()
+	defer t.Mu.Unlock()
+	t.onCommit = append(t.onCommit, fn)
 }
 
-func (t *TransactionCtx) Commit() error {
+// OnRollback registers fn to run when the transaction, or the savepoint of a
+// nested transaction, is rolled back. err is the reason for the rollback.
+func (t *TransactionCtx) OnRollback(fn func(ctx context.Context, err error)) {
 	t.Mu.Lock()
 	defer t.Mu.Unlock()
+	t.onRollback = append(t.onRollback, fn)
+}
+
+// End commits the transaction, or rolls it back when err is non-nil, and then
+// runs the matching hooks. Hooks run at most once, even if End is called
+// again, and also when no statement ever opened the transaction.
+//
+// The transaction does not end when the context it was opened with is
+// cancelled, see begin. An open transaction whose ctx is done by the time End
+// runs, e.g. a request past its deadline, is rolled back here instead and End
+// returns the context's error.
+//
+// Tenant pools used under t stay open until End has run the hooks.
+func (t *TransactionCtx) End(ctx context.Context, err error) error {
+	defer t.releaseTenants()
+	cancelled := err == nil && ctx.Err() != nil && t.Active()
+	if cancelled {
+		err = ctx.Err()
+	}
+	// Ending a savepoint must not fail just because ctx is done.
+	ctx = context.WithoutCancel(ctx)
+	if err != nil {
+		rbErr := t.Rollback(ctx)
+		t.runRollbackHooks(ctx, err)
+		if cancelled && rbErr == nil {
+			return err
+		}
+		return rbErr
+	}
+	if err := t.Commit(ctx); err != nil {
+		err = TranslateError(err)
+		t.runRollbackHooks(ctx, err)
+		return err
+	}
+	t.runCommitHooks(ctx)
+	return nil
+}
+
+func (t *TransactionCtx) takeHooks() ([]func(ctx context.Context), []func(ctx context.Context, err error)) {
+	t.Mu.Lock()
+	defer t.Mu.Unlock()
+	onCommit, onRollback := t.onCommit, t.onRollback
+	t.onCommit, t.onRollback = nil, nil
+	return onCommit, onRollback
+}
+
+func (t *TransactionCtx) runCommitHooks(ctx context.Context) {
+	onCommit, onRollback := t.takeHooks()
+	if t.parent != nil {
+		t.parent.Mu.Lock()
+		t.parent.onCommit = append(t.parent.onCommit, onCommit...)
+		t.parent.onRollback = append(t.parent.onRollback, onRollback...)
+		t.parent.Mu.Unlock()
+		return
+	}
+	ctx = hookCtx(ctx)
+	for _, fn := range onCommit {
+		fn(ctx)
+	}
+}
+
+func (t *TransactionCtx) runRollbackHooks(ctx context.Context, err error) {
+	_, onRollback := t.takeHooks()
+	ctx = hookCtx(ctx)
+	for _, fn := range onRollback {
+		fn(ctx, err)
+	}
+}
+
+// hookCtx detaches hooks from the request: they outlive its cancellation,
+// see no transaction and read from master so they observe what was just
+// committed. Hooks whose context needs a session set up, for a schema tenant
+// or session variables, get ErrSessionNeedsTx from the connection getters
+// and run their queries through RunInTx instead.
+func hookCtx(ctx context.Context) context.Context {
+	ctx = context.WithValue(context.WithoutCancel(ctx), TransactionCtxKey, (*TransactionCtx)(nil))
+
+	var setting CustomSettingCtx
+	if current, ok := ctx.Value(CustomSettingCtxKey).(*CustomSettingCtx); ok && current != nil {
+		setting = *current
+	}
+	setting.IsJobAfterTxCommit = true
+	return context.WithValue(ctx, CustomSettingCtxKey, &setting)
+}
+
+// SetTxOptions declares the options the request transaction is opened with.
+// It must be called before the first GetWriteConnection of the request.
+func SetTxOptions(ctx context.Context, opts *TxOptions) error {
+	transactionCtx, ok := ctx.Value(TransactionCtxKey).(*TransactionCtx)
+	if !ok || transactionCtx == nil {
+		return ErrNoTransactionCtx
+	}
+	transactionCtx.Mu.Lock()
+	defer transactionCtx.Mu.Unlock()
+	if transactionCtx.Conn != nil {
+		return ErrTxAlreadyStarted
+	}
+	transactionCtx.Options = opts
+	return nil
+}
+
+// begin lazily opens the request transaction on db. Every later call, and
+// every read through GetReadConnection, shares the same *sqlx.Tx until the
+// transaction is committed or rolled back. setup, when not nil, runs right
+// after BEGIN; an error from it rolls the transaction back.
+//
+// database/sql rolls a transaction back as soon as the context it began with
+// is done, and ctx is only the context of the first statement, often a
+// helper's short timeout. So the transaction begins detached from its
+// cancellation: each statement still obeys its own ctx and End rolls back.
+func (t *TransactionCtx) begin(ctx context.Context, db *sqlx.DB, setup func(ctx context.Context, tx *sqlx.Tx) error) (*sqlx.Tx, error) {
+	t.Mu.Lock()
+	defer t.Mu.Unlock()
+	if t.Conn == nil && (t.parent != nil || t.ended) {
+		return nil, ErrTxEnded
+	}
+	if t.Conn == nil {
+		var opts *sql.TxOptions
+		if t.Options != nil {
+			opts = &sql.TxOptions{Isolation: t.Options.Isolation, ReadOnly: t.Options.ReadOnly}
+		}
+		// The transaction runs on a dedicated connection so native pgx
+		// calls can reach the same session through sql.Conn.Raw.
+		sqlConn, err := db.Connx(ctx)
+		if err != nil {
+			return nil, err
+		}
+		tx, err := sqlConn.BeginTxx(context.WithoutCancel(ctx), opts)
+		if err != nil {
+			_ = sqlConn.Close()
+			return nil, err
+		}
+		if t.Options != nil && t.Options.Deferrable {
+			if _, err := tx.ExecContext(ctx, "SET TRANSACTION DEFERRABLE"); err != nil {
+				_ = tx.Rollback()
+				_ = sqlConn.Close()
+				return nil, err
+			}
+		}
+		if setup != nil {
+			if err := setup(ctx, tx); err != nil {
+				_ = tx.Rollback()
+				_ = sqlConn.Close()
+				return nil, err
+			}
+		}
+		t.Conn = tx
+		t.sqlConn = sqlConn
+	}
+	return t.Conn, nil
+}
+
+// beginRead returns the transaction reads of a context with session settings
+// run in: the request transaction once it is open, otherwise a read-only
+// transaction of their own, opened on the pool pick returns, set up with
+// setup and shared by every later read until End. It does not commit
+// anything, so reads keep going to replicas and only a write opens the
+// request transaction on master.
+func (t *TransactionCtx) beginRead(ctx context.Context, pick func() (*sqlx.DB, *replica, error), setup func(ctx context.Context, tx *sqlx.Tx) error) (*sqlx.Tx, *replica, error) {
+	t.Mu.Lock()
+	defer t.Mu.Unlock()
+	switch {
+	case t.Conn != nil:
+		return t.Conn, nil, nil
+	case t.readTx != nil:
+		return t.readTx, t.readReplica, nil
+	case t.parent != nil || t.ended:
+		return nil, nil, ErrTxEnded
+	}
+
+	db, r, err := pick()
+	if err != nil {
+		return nil, nil, err
+	}
+	sqlConn, err := db.Connx(ctx)
+	if err != nil {
+		return nil, nil, err
+	}
+	tx, err := sqlConn.BeginTxx(context.WithoutCancel(ctx), &sql.TxOptions{ReadOnly: true})
+	if err != nil {
+		_ = sqlConn.Close()
+		return nil, nil, err
+	}
+	if err := setup(ctx, tx); err != nil {
+		_ = tx.Rollback()
+		_ = sqlConn.Close()
+		return nil, nil, err
+	}
+	t.readTx, t.readConn, t.readReplica = tx, sqlConn, r
+	return tx, r, nil
+}
+
+// endRead ends the read-only transaction of beginRead. Callers hold t.Mu.
+func (t *TransactionCtx) endRead() {
+	if t.readTx == nil {
+		return
+	}
+	_ = t.readTx.Rollback()
+	_ = t.readConn.Close()
+	t.readTx, t.readConn, t.readReplica = nil, nil, nil
+}
+
+// markWrite records that a write connection was handed out for the
+// transaction of t.
+func (t *TransactionCtx) markWrite() {
+	root := t.root()
+	root.Mu.Lock()
+	defer root.Mu.Unlock()
+	root.wrote = true
+}
+
+// markCommitted records on the root of t that a transaction next to it
+// committed a write.
+func (t *TransactionCtx) markCommitted() {
+	root := t.root()
+	root.Mu.Lock()
+	defer root.Mu.Unlock()
+	root.committed = true
+}
+
+// holdTenant makes the root of t keep the pool of tenant id open until End,
+// which calls release. It reports false when the root already holds id or
+// has ended, in which case the caller releases right away.
+func (t *TransactionCtx) holdTenant(id string, release func()) bool {
+	root := t.root()
+	root.Mu.Lock()
+	defer root.Mu.Unlock()
+	if root.ended {
+		return false
+	}
+	if _, ok := root.tenantRefs[id]; ok {
+		return false
+	}
+	if root.tenantRefs == nil {
+		root.tenantRefs = make(map[string]func())
+	}
+	root.tenantRefs[id] = release
+	return true
+}
+
+func (t *TransactionCtx) releaseTenants() {
+	if t.parent != nil {
+		return
+	}
+	t.Mu.Lock()
+	refs := t.tenantRefs
+	t.tenantRefs = nil
+	t.Mu.Unlock()
+	for _, release := range refs {
+		release()
+	}
+}
+
+// raw runs fn on the pgx connection of the open transaction.
+func (t *TransactionCtx) raw(fn func(conn NativeConn) error) error {
+	t.Mu.Lock()
+	sqlConn, active := t.sqlConn, t.Conn != nil
+	t.Mu.Unlock()
+	if !active {
+		return ErrTxEnded
+	}
+	return rawConn(sqlConn, fn)
+}
+
+// rawRead is raw for reads: it falls back to the read-only transaction of
+// beginRead while the request transaction is not open.
+func (t *TransactionCtx) rawRead(fn func(conn NativeConn) error) error {
+	t.Mu.Lock()
+	sqlConn := t.readConn
+	if t.Conn != nil {
+		sqlConn = t.sqlConn
+	}
+	t.Mu.Unlock()
+	if sqlConn == nil {
+		return ErrTxEnded
+	}
+	return rawConn(sqlConn, fn)
+}
+
+// release hands the dedicated connection back to the pool once the
+// transaction has ended. Callers hold t.Mu.
+func (t *TransactionCtx) release() {
+	t.Conn = nil
+	t.ended = true
+	if t.parent == nil {
+		if t.sqlConn != nil {
+			_ = t.sqlConn.Close()
+		}
+		t.savepointsMu.Lock()
+		t.openSavepoints = nil
+		t.savepointsMu.Unlock()
+	}
+	t.sqlConn = nil
+}
+
+func (t *TransactionCtx) root() *TransactionCtx {
+	root := t
+	for root.parent != nil {
+		root = root.parent
+	}
+	return root
+}
+
+// nest opens a SAVEPOINT in the running transaction and returns the
+// TransactionCtx that owns it.
+func (t *TransactionCtx) nest(ctx context.Context) (*TransactionCtx, error) {
+	t.Mu.Lock()
+	defer t.Mu.Unlock()
+	if t.Conn == nil {
+		return nil, ErrTxEnded
+	}
+
+	// Savepoints are numbered per transaction rather than per depth, so a
+	// name is never reused while an earlier savepoint of that name could
+	// still be open.
+	root := t.root()
+	savepoint := fmt.Sprintf("sp_%d", root.savepoints.Add(1))
+	if _, err := t.Conn.ExecContext(ctx, "SAVEPOINT "+savepoint); err != nil {
+		return nil, err
+	}
+	nested := &TransactionCtx{
+		Conn:      t.Conn,
+		sqlConn:   t.sqlConn,
+		Options:   t.Options,
+		parent:    t,
+		savepoint: savepoint,
+	}
+	root.savepointsMu.Lock()
+	root.openSavepoints = append(root.openSavepoints, nested)
+	root.savepointsMu.Unlock()
+	return nested, nil
+}
+
+// endSavepoint removes nested, whose savepoint is about to be released or
+// rolled back to, from the open savepoints of its transaction. It fails
+// unless nested is the innermost one: ending it would silently destroy the
+// savepoints opened after it, whose own end would then fail on the server.
+func (t *TransactionCtx) endSavepoint(nested *TransactionCtx) error {
+	t.savepointsMu.Lock()
+	defer t.savepointsMu.Unlock()
+	n := len(t.openSavepoints)
+	if n == 0 {
+		return ErrTxEnded
+	}
+	if t.openSavepoints[n-1] != nested {
+		return fmt.Errorf("end %s: %w", nested.savepoint, ErrSavepointNotInnermost)
+	}
+	t.openSavepoints = t.openSavepoints[:n-1]
+	return nil
+}
+
+// wantsTx reports whether reads must open the transaction: declared options
+// mean the whole request runs in it, unless it already ended.
+func (t *TransactionCtx) wantsTx() bool {
+	t.Mu.Lock()
+	defer t.Mu.Unlock()
+	return t.Options != nil && !t.ended
+}
+
+func (t *TransactionCtx) current() *sqlx.Tx {
+	t.Mu.Lock()
+	defer t.Mu.Unlock()
+	return t.Conn
+}
+
+// Active reports whether a transaction has been opened and not yet ended.
+func (t *TransactionCtx) Active() bool {
+	return t.current() != nil
+}
+
+func (t *TransactionCtx) Commit(ctx context.Context) error {
+	t.Mu.Lock()
+	defer t.Mu.Unlock()
+	if t.Conn != nil && t.parent != nil {
+		if err := t.root().endSavepoint(t); err != nil {
+			return err
+		}
+		_, err := t.Conn.ExecContext(ctx, "RELEASE SAVEPOINT "+t.savepoint)
+		t.release()
+		return err
+	}
+	t.endRead()
 	if t.Conn != nil {
-		return t.Conn.Commit()
+		// The transaction is finished either way: a failed commit has
+		// already been rolled back by the server.
+		err := t.Conn.Commit()
+		t.release()
+		if err != nil {
+			return err
+		}
+		t.committed = t.committed || t.wrote
 	}
+	t.ended = true
 	return nil
 }
 
-func (t *TransactionCtx) Rollback() error {
+// Committed reports whether this context has committed a transaction it took
+// a write connection for, including one of RunInNewTx. Reads issued
+// afterwards must go to master to see their own writes.
+func (t *TransactionCtx) Committed() bool {
 	t.Mu.Lock()
 	defer t.Mu.Unlock()
+	return t.committed
+}
+
+func (t *TransactionCtx) Rollback(ctx context.Context) error {
+	t.Mu.Lock()
+	defer t.Mu.Unlock()
+	if t.Conn != nil && t.parent != nil {
+		if err := t.root().endSavepoint(t); err != nil {
+			return err
+		}
+		defer t.release()
+		if _, err := t.Conn.ExecContext(ctx, "ROLLBACK TO SAVEPOINT "+t.savepoint); err != nil {
+			return err
+		}
+		_, err := t.Conn.ExecContext(ctx, "RELEASE SAVEPOINT "+t.savepoint)
+		return err
+	}
+	t.endRead()
 	if t.Conn != nil {
-		return t.Conn.Rollback()
+		err := t.Conn.Rollback()
+		t.release()
+		return err
 	}
+	t.ended = true
 	return nil
 }
 
 type CustomSettingCtx struct {
 	IsJobAfterTxCommit bool
+	// StickyPrimary routes reads to master, set for clients that wrote
+	// recently so they read their own writes despite replication lag.
+	StickyPrimary bool
 }
 
 type TransactionCtxKeyType string
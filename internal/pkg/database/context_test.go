@@ -0,0 +1,197 @@
+package database
+
+import (
+	"context"
+	"errors"
+	"go-starter-kit/internal/pkg/jwt"
+	"go-starter-kit/internal/server/config"
+	"testing"
+	"time"
+)
+
+const setConfigQuery = "SELECT set_config(s.name, s.value, true) FROM unnest($1::text[], $2::text[]) AS s(name, value)"
+
+func exec(t *testing.T, p *Postgres, ctx context.Context, query string) {
+	t.Helper()
+	conn, err := p.GetWriteConnection(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := conn.ExecContext(ctx, query); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func read(t *testing.T, p *Postgres, ctx context.Context, query string) {
+	t.Helper()
+	conn, err := p.GetReadConnection(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := conn.ExecContext(ctx, query); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// newFakeSessionPostgres returns a fake Postgres with one replica whose
+// requests carry session variables.
+func newFakeSessionPostgres(t *testing.T) (p *Postgres, master, standby *fakeConnector) {
+	t.Helper()
+	p, master = newFakePostgres(t)
+	db, standby := newFakeDB(t)
+	p.replicas = []*replica{newReplica("replica-0", db, nil, 1, nil)}
+	p.balancer = &roundRobin{}
+	var err error
+	if p.sessionVars, err = newSessionVariables(config.SessionVariables{UID: "app.uid"}); err != nil {
+		t.Fatal(err)
+	}
+	return p, master, standby
+}
+
+// TestTxOutlivesStatementContext checks that a short-lived context that
+// happened to open the request transaction does not end it.
+func TestTxOutlivesStatementContext(t *testing.T) {
+	p, fake := newFakePostgres(t)
+	transactionCtx := &TransactionCtx{}
+	ctx := context.WithValue(context.Background(), TransactionCtxKey, transactionCtx)
+
+	helperCtx, cancel := context.WithTimeout(ctx, time.Minute)
+	exec(t, p, helperCtx, "INSERT 1")
+	cancel()
+	// database/sql would roll back in the background by now.
+	time.Sleep(20 * time.Millisecond)
+	exec(t, p, ctx, "INSERT 2")
+
+	if err := transactionCtx.End(ctx, nil); err != nil {
+		t.Fatal(err)
+	}
+	wantStatements(t, fake, "BEGIN", "INSERT 1", "INSERT 2", "COMMIT")
+}
+
+func TestEndRollsBackCancelledContext(t *testing.T) {
+	p, fake := newFakePostgres(t)
+	transactionCtx := &TransactionCtx{}
+	ctx, cancel := context.WithCancel(context.WithValue(context.Background(), TransactionCtxKey, transactionCtx))
+	exec(t, p, ctx, "INSERT 1")
+	cancel()
+
+	if err := transactionCtx.End(ctx, nil); !errors.Is(err, context.Canceled) {
+		t.Errorf("End() error = %v, want %v", err, context.Canceled)
+	}
+	wantStatements(t, fake, "BEGIN", "INSERT 1", "ROLLBACK")
+
+	// Nothing to roll back when no statement ran.
+	unopened := &TransactionCtx{}
+	if err := unopened.End(ctx, nil); err != nil {
+		t.Errorf("End() of an unopened transaction error = %v, want nil", err)
+	}
+}
+
+// TestSessionReadsOnReplica checks that reads needing session variables share
+// one read-only transaction on a replica and leave master alone.
+func TestSessionReadsOnReplica(t *testing.T) {
+	p, master, standby := newFakeSessionPostgres(t)
+	transactionCtx := &TransactionCtx{}
+	ctx := context.WithValue(context.Background(), TransactionCtxKey, transactionCtx)
+	ctx = jwt.WithUserClaims(ctx, &jwt.UserClaims{UID: 7})
+
+	read(t, p, ctx, "SELECT 1")
+	read(t, p, ctx, "SELECT 2")
+	if err := transactionCtx.End(ctx, nil); err != nil {
+		t.Fatal(err)
+	}
+	wantStatements(t, standby, "BEGIN READ ONLY", setConfigQuery, "SELECT 1", "SELECT 2", "ROLLBACK")
+	wantStatements(t, master)
+	if transactionCtx.Committed() {
+		t.Error("Committed() = true after a request that only read")
+	}
+}
+
+// TestSessionWriteAfterRead checks that a write opens the request transaction
+// on master, which then serves the reads, and that only it commits.
+func TestSessionWriteAfterRead(t *testing.T) {
+	p, master, standby := newFakeSessionPostgres(t)
+	transactionCtx := &TransactionCtx{}
+	ctx := context.WithValue(context.Background(), TransactionCtxKey, transactionCtx)
+	ctx = jwt.WithUserClaims(ctx, &jwt.UserClaims{UID: 7})
+
+	read(t, p, ctx, "SELECT 1")
+	exec(t, p, ctx, "INSERT 1")
+	read(t, p, ctx, "SELECT 2")
+	if err := transactionCtx.End(ctx, nil); err != nil {
+		t.Fatal(err)
+	}
+	wantStatements(t, standby, "BEGIN READ ONLY", setConfigQuery, "SELECT 1", "ROLLBACK")
+	wantStatements(t, master, "BEGIN", setConfigQuery, "INSERT 1", "SELECT 2", "COMMIT")
+	if !transactionCtx.Committed() {
+		t.Error("Committed() = false after a request that wrote")
+	}
+}
+
+// TestReadOnlyTxNotCommitted checks that a request transaction that was only
+// read from does not count as Committed, so no sticky cookie follows it.
+func TestReadOnlyTxNotCommitted(t *testing.T) {
+	p, master := newFakePostgres(t)
+	transactionCtx := &TransactionCtx{Options: &TxOptions{}}
+	ctx := context.WithValue(context.Background(), TransactionCtxKey, transactionCtx)
+
+	read(t, p, ctx, "SELECT 1")
+	if err := transactionCtx.End(ctx, nil); err != nil {
+		t.Fatal(err)
+	}
+	wantStatements(t, master, "BEGIN", "SELECT 1", "COMMIT")
+	if transactionCtx.Committed() {
+		t.Error("Committed() = true after a request that only read")
+	}
+}
+
+func TestSavepoints(t *testing.T) {
+	p, fake := newFakePostgres(t)
+	transactionCtx := &TransactionCtx{}
+	ctx := context.WithValue(context.Background(), TransactionCtxKey, transactionCtx)
+	begin := func(ctx context.Context) context.Context {
+		t.Helper()
+		nested, err := p.Begin(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return nested
+	}
+
+	outer := begin(ctx)
+	inner := begin(outer)
+	if err := p.EndCtx(inner, errors.New("boom")); err != nil {
+		t.Fatalf("EndCtx(inner) error = %v", err)
+	}
+	if err := p.EndCtx(outer, nil); err != nil {
+		t.Fatalf("EndCtx(outer) error = %v", err)
+	}
+	wantStatements(t, fake, "BEGIN", "SAVEPOINT sp_1", "SAVEPOINT sp_2",
+		"ROLLBACK TO SAVEPOINT sp_2", "RELEASE SAVEPOINT sp_2", "RELEASE SAVEPOINT sp_1")
+
+	// Siblings share the stack: the first one cannot end before the second.
+	first, second := begin(ctx), begin(ctx)
+	if err := p.EndCtx(first, nil); !errors.Is(err, ErrSavepointNotInnermost) {
+		t.Errorf("EndCtx(first) before second error = %v, want %v", err, ErrSavepointNotInnermost)
+	}
+	if err := p.EndCtx(first, errors.New("boom")); !errors.Is(err, ErrSavepointNotInnermost) {
+		t.Errorf("rolling back first before second error = %v, want %v", err, ErrSavepointNotInnermost)
+	}
+	if err := p.EndCtx(second, nil); err != nil {
+		t.Fatalf("EndCtx(second) error = %v", err)
+	}
+	if err := p.EndCtx(first, nil); err != nil {
+		t.Fatalf("EndCtx(first) error = %v", err)
+	}
+	wantStatements(t, fake, "SAVEPOINT sp_3", "SAVEPOINT sp_4", "RELEASE SAVEPOINT sp_4", "RELEASE SAVEPOINT sp_3")
+
+	// Ending the transaction ends its savepoints with it.
+	left := begin(ctx)
+	if err := transactionCtx.End(ctx, nil); err != nil {
+		t.Fatal(err)
+	}
+	if err := p.EndCtx(left, nil); !errors.Is(err, ErrTxEnded) {
+		t.Errorf("EndCtx after the transaction ended error = %v, want %v", err, ErrTxEnded)
+	}
+	wantStatements(t, fake, "SAVEPOINT sp_5", "COMMIT")
+}
@@ -0,0 +1,98 @@
+package database
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"github.com/jackc/pgconn"
+)
+
+// Classes of database errors. Errors returned by Conn match one of them with
+// errors.Is when the cause is known, e.g.
+//
+//	if errors.Is(err, database.ErrConflict) {
+//		c.JSON(http.StatusConflict, ...)
+//	}
+var (
+	ErrNotFound       = errors.New("record not found")
+	ErrConflict       = errors.New("unique violation")
+	ErrForeignKey     = errors.New("foreign key violation")
+	ErrCheckViolation = errors.New("check violation")
+	ErrTimeout        = errors.New("database timeout")
+	// ErrSerialization covers serialization failures and deadlocks, after
+	// which re-running the whole transaction is expected to succeed.
+	ErrSerialization = errors.New("serialization failure")
+)
+
+// errorKinds maps SQLSTATEs to the class they belong to.
+var errorKinds = map[string]error{
+	"23505": ErrConflict,       // unique_violation
+	"23503": ErrForeignKey,     // foreign_key_violation
+	"23514": ErrCheckViolation, // check_violation
+	"40001": ErrSerialization,  // serialization_failure
+	"40P01": ErrSerialization,  // deadlock_detected
+	"57014": ErrTimeout,        // query_canceled, raised by statement_timeout
+	"55P03": ErrTimeout,        // lock_not_available, raised by lock_timeout
+	"25P03": ErrTimeout,        // idle_in_transaction_session_timeout
+}
+
+// Error is a classified database error. errors.Is matches both Kind and the
+// original error, and errors.As still reaches the *pgconn.PgError.
+type Error struct {
+	Kind error
+	// Code is the SQLSTATE, empty when the error did not come from Postgres.
+	Code       string
+	Table      string
+	Column     string
+	Constraint string
+	Detail     string
+	Err        error
+}
+
+func (e *Error) Error() string {
+	if e.Constraint != "" {
+		return fmt.Sprintf("%s on %s: %s", e.Kind, e.Constraint, e.Err)
+	}
+	return fmt.Sprintf("%s: %s", e.Kind, e.Err)
+}
+
+func (e *Error) Unwrap() []error {
+	return []error{e.Kind, e.Err}
+}
+
+// TranslateError classifies err into an *Error. Errors of no known class are
+// returned unchanged, as is nil.
+func TranslateError(err error) error {
+	if err == nil {
+		return nil
+	}
+	var classified *Error
+	if errors.As(err, &classified) {
+		return err
+	}
+
+	var pgErr *pgconn.PgError
+	switch {
+	case errors.As(err, &pgErr):
+		kind, ok := errorKinds[pgErr.Code]
+		if !ok {
+			return err
+		}
+		return &Error{
+			Kind:       kind,
+			Code:       pgErr.Code,
+			Table:      pgErr.TableName,
+			Column:     pgErr.ColumnName,
+			Constraint: pgErr.ConstraintName,
+			Detail:     pgErr.Detail,
+			Err:        err,
+		}
+	case errors.Is(err, sql.ErrNoRows):
+		return &Error{Kind: ErrNotFound, Err: err}
+	case errors.Is(err, context.DeadlineExceeded), pgconn.Timeout(err):
+		return &Error{Kind: ErrTimeout, Err: err}
+	default:
+		return err
+	}
+}
@@ -0,0 +1,93 @@
+package database
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"github.com/jackc/pgconn"
+	"testing"
+)
+
+func TestTranslateError(t *testing.T) {
+	unique := &pgconn.PgError{
+		Code:           "23505",
+		TableName:      "users",
+		ConstraintName: "users_email_key",
+		Detail:         "Key (email)=(a@b.c) already exists.",
+	}
+	tests := []struct {
+		name     string
+		err      error
+		wantKind error
+	}{
+		{name: "unique violation", err: unique, wantKind: ErrConflict},
+		{name: "wrapped", err: fmt.Errorf("insert user: %w", unique), wantKind: ErrConflict},
+		{name: "foreign key", err: &pgconn.PgError{Code: "23503"}, wantKind: ErrForeignKey},
+		{name: "check", err: &pgconn.PgError{Code: "23514"}, wantKind: ErrCheckViolation},
+		{name: "serialization", err: &pgconn.PgError{Code: "40001"}, wantKind: ErrSerialization},
+		{name: "deadlock", err: &pgconn.PgError{Code: "40P01"}, wantKind: ErrSerialization},
+		{name: "statement timeout", err: &pgconn.PgError{Code: "57014"}, wantKind: ErrTimeout},
+		{name: "lock timeout", err: &pgconn.PgError{Code: "55P03"}, wantKind: ErrTimeout},
+		{name: "no rows", err: sql.ErrNoRows, wantKind: ErrNotFound},
+		{name: "deadline", err: fmt.Errorf("query: %w", context.DeadlineExceeded), wantKind: ErrTimeout},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := TranslateError(tt.err)
+			var classified *Error
+			if !errors.As(got, &classified) || classified.Kind != tt.wantKind {
+				t.Fatalf("TranslateError() = %v, want kind %v", got, tt.wantKind)
+			}
+			if !errors.Is(got, tt.wantKind) || !errors.Is(got, tt.err) {
+				t.Errorf("errors.Is misses the kind or the original error")
+			}
+			if TranslateError(got) != got {
+				t.Errorf("translating twice wraps the error again")
+			}
+		})
+	}
+}
+
+func TestTranslateErrorFields(t *testing.T) {
+	err := TranslateError(&pgconn.PgError{
+		Severity:       "ERROR",
+		Code:           "23505",
+		Message:        "duplicate key value violates unique constraint",
+		TableName:      "users",
+		ColumnName:     "email",
+		ConstraintName: "users_email_key",
+		Detail:         "Key (email)=(a@b.c) already exists.",
+	})
+	var classified *Error
+	if !errors.As(err, &classified) {
+		t.Fatalf("TranslateError() = %v, want an *Error", err)
+	}
+	if classified.Code != "23505" || classified.Table != "users" || classified.Column != "email" ||
+		classified.Constraint != "users_email_key" || classified.Detail == "" {
+		t.Errorf("fields = %+v, want them copied from the PgError", classified)
+	}
+	var pgErr *pgconn.PgError
+	if !errors.As(err, &pgErr) {
+		t.Error("errors.As no longer reaches the *pgconn.PgError")
+	}
+	want := "unique violation on users_email_key: ERROR: duplicate key value violates unique constraint (SQLSTATE 23505)"
+	if err.Error() != want {
+		t.Errorf("Error() = %q, want %q", err.Error(), want)
+	}
+}
+
+func TestTranslateErrorUnchanged(t *testing.T) {
+	if TranslateError(nil) != nil {
+		t.Error("TranslateError(nil) is not nil")
+	}
+	for _, err := range []error{
+		errors.New("boom"),
+		&pgconn.PgError{Code: "42P01"}, // undefined_table
+		context.Canceled,
+	} {
+		if got := TranslateError(err); got != err {
+			t.Errorf("TranslateError(%v) = %v, want it unchanged", err, got)
+		}
+	}
+}
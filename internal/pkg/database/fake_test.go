@@ -0,0 +1,109 @@
+package database
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"errors"
+	"github.com/jmoiron/sqlx"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeConnector hands out connections that record the statements sent to
+// them and run nothing, enough to drive pools and transactions without a
+// server. Exec style statements succeed; queries fail.
+type fakeConnector struct {
+	mu         sync.Mutex
+	statements []string
+}
+
+func (c *fakeConnector) Connect(context.Context) (driver.Conn, error) { return &fakeConn{c: c}, nil }
+func (c *fakeConnector) Driver() driver.Driver                        { return nil }
+
+func (c *fakeConnector) record(statement string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.statements = append(c.statements, statement)
+}
+
+// take returns the statements recorded since the last call.
+func (c *fakeConnector) take() []string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	statements := c.statements
+	c.statements = nil
+	return statements
+}
+
+type fakeConn struct {
+	c *fakeConnector
+}
+
+func (*fakeConn) Prepare(string) (driver.Stmt, error) { return nil, errors.New("not supported") }
+func (*fakeConn) Close() error                        { return nil }
+func (*fakeConn) CheckNamedValue(*driver.NamedValue) error {
+	return nil
+}
+
+func (c *fakeConn) Begin() (driver.Tx, error) {
+	return c.BeginTx(context.Background(), driver.TxOptions{})
+}
+
+func (c *fakeConn) BeginTx(_ context.Context, opts driver.TxOptions) (driver.Tx, error) {
+	if opts.ReadOnly {
+		c.c.record("BEGIN READ ONLY")
+	} else {
+		c.c.record("BEGIN")
+	}
+	return &fakeTx{c: c.c}, nil
+}
+
+func (c *fakeConn) ExecContext(_ context.Context, query string, _ []driver.NamedValue) (driver.Result, error) {
+	c.c.record(query)
+	return driver.RowsAffected(0), nil
+}
+
+type fakeTx struct {
+	c *fakeConnector
+}
+
+func (tx *fakeTx) Commit() error {
+	tx.c.record("COMMIT")
+	return nil
+}
+
+func (tx *fakeTx) Rollback() error {
+	tx.c.record("ROLLBACK")
+	return nil
+}
+
+func newFakeDB(t *testing.T) (*sqlx.DB, *fakeConnector) {
+	t.Helper()
+	connector := &fakeConnector{}
+	db := sqlx.NewDb(sql.OpenDB(connector), "pgx")
+	t.Cleanup(func() { _ = db.Close() })
+	return db, connector
+}
+
+// newFakePostgres returns a Postgres whose master is a fake database.
+func newFakePostgres(t *testing.T) (*Postgres, *fakeConnector) {
+	t.Helper()
+	db, connector := newFakeDB(t)
+	return &Postgres{
+		logger:     newTestLogger(t),
+		masterInfo: connectionInfo{Name: "master"},
+		writeDB:    db,
+		retry:      retryPolicy{maxAttempts: 3, initialBackoff: time.Millisecond, maxBackoff: time.Millisecond},
+		done:       make(chan struct{}),
+	}, connector
+}
+
+func wantStatements(t *testing.T, connector *fakeConnector, want ...string) {
+	t.Helper()
+	if got := connector.take(); !reflect.DeepEqual(got, want) {
+		t.Errorf("statements = %q\nwant         %q", got, want)
+	}
+}
@@ -0,0 +1,100 @@
+package database
+
+import (
+	"context"
+	"github.com/prometheus/client_golang/prometheus"
+	"go-starter-kit/internal/log"
+	"strings"
+	"time"
+)
+
+// SlowQueryHook logs every query that takes at least threshold.
+type SlowQueryHook struct {
+	logger    log.Logger
+	threshold time.Duration
+}
+
+func NewSlowQueryHook(logger log.Logger, threshold time.Duration) *SlowQueryHook {
+	return &SlowQueryHook{
+		logger:    logger.WithPrefix("postgres"),
+		threshold: threshold,
+	}
+}
+
+func (h *SlowQueryHook) BeforeQuery(ctx context.Context, event *QueryEvent) context.Context {
+	return ctx
+}
+
+// AfterQuery leaves the arguments out of the log line since they may carry
+// personal data or secrets.
+func (h *SlowQueryHook) AfterQuery(ctx context.Context, event *QueryEvent) {
+	if event.Duration < h.threshold {
+		return
+	}
+	fields := map[string]interface{}{
+		"route":       event.Route,
+		"target":      event.Target,
+		"in_tx":       event.InTx,
+		"duration_ms": event.Duration.Milliseconds(),
+		"args":        len(event.Args),
+	}
+	if event.RowsAffected >= 0 {
+		fields["rows_affected"] = event.RowsAffected
+	}
+	if event.Err != nil {
+		fields["error"] = event.Err.Error()
+	}
+	h.logger.WithFields(fields).Warnf("slow query: %s", event.Query)
+}
+
+// PrometheusHook records the duration of every query in the
+// db_query_duration_seconds histogram, labelled by route, target pool, SQL
+// operation and outcome.
+type PrometheusHook struct {
+	duration *prometheus.HistogramVec
+}
+
+func NewPrometheusHook(registerer prometheus.Registerer) (*PrometheusHook, error) {
+	duration := prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "db_query_duration_seconds",
+		Help:    "Duration of SQL queries issued through database.Conn.",
+		Buckets: []float64{.001, .0025, .005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10},
+	}, []string{"route", "target", "operation", "status"})
+	if err := registerer.Register(duration); err != nil {
+		return nil, err
+	}
+	return &PrometheusHook{duration: duration}, nil
+}
+
+func (h *PrometheusHook) BeforeQuery(ctx context.Context, event *QueryEvent) context.Context {
+	return ctx
+}
+
+func (h *PrometheusHook) AfterQuery(ctx context.Context, event *QueryEvent) {
+	status := "ok"
+	if event.Err != nil {
+		status = "error"
+	}
+	route := event.Route
+	if route == "" {
+		route = "none"
+	}
+	h.duration.WithLabelValues(route, event.Target, queryOperation(event.Query), status).
+		Observe(event.Duration.Seconds())
+}
+
+// queryOperation returns the leading SQL keyword of query. Anything outside a
+// small fixed set maps to OTHER to keep label cardinality bounded.
+func queryOperation(query string) string {
+	fields := strings.Fields(query)
+	if len(fields) == 0 {
+		return "OTHER"
+	}
+	switch op := strings.ToUpper(fields[0]); op {
+	case "SELECT", "INSERT", "UPDATE", "DELETE", "WITH", "COPY",
+		"BEGIN", "COMMIT", "ROLLBACK", "SAVEPOINT", "RELEASE", "SET":
+		return op
+	default:
+		return "OTHER"
+	}
+}
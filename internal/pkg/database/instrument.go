@@ -0,0 +1,280 @@
+package database
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"github.com/jmoiron/sqlx"
+	"time"
+)
+
+// QueryEvent describes one statement sent through a Conn. Hooks get the same
+// *QueryEvent in BeforeQuery and AfterQuery; Duration, RowsAffected and Err
+// are only set for AfterQuery.
+type QueryEvent struct {
+	Query string
+	Args  []interface{}
+	// Route is the HTTP route that issued the query, see WithRoute.
+	Route string
+	// Target is the name of the pool the query ran on, e.g. "master" or
+	// "replica-0".
+	Target string
+	InTx   bool
+
+	StartedAt time.Time
+	Duration  time.Duration
+	// RowsAffected is only known for Exec style calls and is -1 otherwise.
+	RowsAffected int64
+	Err          error
+}
+
+// QueryHook observes every query issued through a Conn returned by
+// GetReadConnection, GetWriteConnection or RunInTx. BeforeQuery hooks run in
+// registration order and AfterQuery hooks in reverse, so a hook wraps the
+// ones registered after it. Native pgx calls are not observed.
+type QueryHook interface {
+	BeforeQuery(ctx context.Context, event *QueryEvent) context.Context
+	AfterQuery(ctx context.Context, event *QueryEvent)
+}
+
+// AddQueryHook registers hooks for every connection handed out afterwards.
+// Register hooks at startup, before serving traffic.
+func (p *Postgres) AddQueryHook(hooks ...QueryHook) {
+	p.hooksMu.Lock()
+	defer p.hooksMu.Unlock()
+	p.hooks = append(p.hooks[:len(p.hooks):len(p.hooks)], hooks...)
+}
+
+func (p *Postgres) instrument(conn sqlxConn, target string, inTx bool, breaker *breaker) Conn {
+	p.hooksMu.RLock()
+	hooks := p.hooks
+	p.hooksMu.RUnlock()
+	return &instrumentedConn{conn: conn, hooks: hooks, target: target, inTx: inTx, breaker: breaker}
+}
+
+type RouteCtxKeyType string
+
+const (
+	RouteCtxKey RouteCtxKeyType = "route"
+)
+
+// WithRoute records the route that handles the request, so query hooks can
+// attribute queries to it.
+func WithRoute(ctx context.Context, route string) context.Context {
+	return context.WithValue(ctx, RouteCtxKey, route)
+}
+
+func RouteFromCtx(ctx context.Context) string {
+	route, _ := ctx.Value(RouteCtxKey).(string)
+	return route
+}
+
+// sqlxConn is the part of *sqlx.DB and *sqlx.Tx that instrumentedConn builds
+// Conn on.
+type sqlxConn interface {
+	BindNamed(query string, arg interface{}) (string, []interface{}, error)
+	DriverName() string
+	Rebind(query string) string
+
+	ExecContext(ctx context.Context, query string, args ...interface{}) (sql.Result, error)
+	MustExecContext(ctx context.Context, query string, args ...interface{}) sql.Result
+	NamedExecContext(ctx context.Context, query string, arg interface{}) (sql.Result, error)
+	GetContext(ctx context.Context, dest interface{}, query string, args ...interface{}) error
+	SelectContext(ctx context.Context, dest interface{}, query string, args ...interface{}) error
+	QueryContext(ctx context.Context, query string, args ...interface{}) (*sql.Rows, error)
+	QueryRowContext(ctx context.Context, query string, args ...interface{}) *sql.Row
+	QueryxContext(ctx context.Context, query string, args ...interface{}) (*sqlx.Rows, error)
+	QueryRowxContext(ctx context.Context, query string, args ...interface{}) *sqlx.Row
+	PrepareNamedContext(ctx context.Context, query string) (*sqlx.NamedStmt, error)
+	PreparexContext(ctx context.Context, query string) (*sqlx.Stmt, error)
+}
+
+// instrumentedConn implements Conn on top of a pool or a *sqlx.Tx and runs
+// every statement through the hook chain. Outcomes also feed the circuit
+// breaker of the pool.
+type instrumentedConn struct {
+	conn    sqlxConn
+	hooks   []QueryHook
+	target  string
+	inTx    bool
+	breaker *breaker
+}
+
+// observe runs fn between the hooks and classifies its error with
+// TranslateError. fn reports the rows it affected, or -1 when that is
+// unknown. A panic inside fn, e.g. from MustExecContext, is reported to the
+// hooks as an error before it is re-raised.
+func (c *instrumentedConn) observe(ctx context.Context, query string, args []interface{}, fn func(ctx context.Context) (int64, error)) error {
+	event := &QueryEvent{
+		Query:        query,
+		Args:         args,
+		Route:        RouteFromCtx(ctx),
+		Target:       c.target,
+		InTx:         c.inTx,
+		RowsAffected: -1,
+	}
+	for _, hook := range c.hooks {
+		ctx = hook.BeforeQuery(ctx, event)
+	}
+
+	event.StartedAt = time.Now()
+	defer func() {
+		event.Duration = time.Since(event.StartedAt)
+		r := recover()
+		if r != nil {
+			event.Err = fmt.Errorf("panic: %v", r)
+		}
+		for i := len(c.hooks) - 1; i >= 0; i-- {
+			c.hooks[i].AfterQuery(ctx, event)
+		}
+		if r != nil {
+			panic(r)
+		}
+	}()
+
+	rows, err := fn(ctx)
+	c.breaker.record(ctx, err)
+	event.RowsAffected, event.Err = rows, TranslateError(err)
+	return event.Err
+}
+
+func resultRows(result sql.Result) int64 {
+	if result == nil {
+		return -1
+	}
+	rows, err := result.RowsAffected()
+	if err != nil {
+		return -1
+	}
+	return rows
+}
+
+func (c *instrumentedConn) BindNamed(query string, arg interface{}) (string, []interface{}, error) {
+	return c.conn.BindNamed(query, arg)
+}
+
+func (c *instrumentedConn) DriverName() string {
+	return c.conn.DriverName()
+}
+
+func (c *instrumentedConn) Rebind(query string) string {
+	return c.conn.Rebind(query)
+}
+
+func (c *instrumentedConn) ExecContext(ctx context.Context, query string, args ...interface{}) (sql.Result, error) {
+	var result sql.Result
+	err := c.observe(ctx, query, args, func(ctx context.Context) (int64, error) {
+		var err error
+		result, err = c.conn.ExecContext(ctx, query, args...)
+		return resultRows(result), err
+	})
+	return result, err
+}
+
+func (c *instrumentedConn) MustExecContext(ctx context.Context, query string, args ...interface{}) sql.Result {
+	var result sql.Result
+	_ = c.observe(ctx, query, args, func(ctx context.Context) (int64, error) {
+		result = c.conn.MustExecContext(ctx, query, args...)
+		return resultRows(result), nil
+	})
+	return result
+}
+
+func (c *instrumentedConn) NamedExecContext(ctx context.Context, query string, arg interface{}) (sql.Result, error) {
+	var result sql.Result
+	err := c.observe(ctx, query, []interface{}{arg}, func(ctx context.Context) (int64, error) {
+		var err error
+		result, err = c.conn.NamedExecContext(ctx, query, arg)
+		return resultRows(result), err
+	})
+	return result, err
+}
+
+// NamedQueryContext is built from BindNamed and QueryxContext because
+// *sqlx.Tx has no NamedQueryContext of its own.
+func (c *instrumentedConn) NamedQueryContext(ctx context.Context, query string, arg interface{}) (*sqlx.Rows, error) {
+	var rows *sqlx.Rows
+	err := c.observe(ctx, query, []interface{}{arg}, func(ctx context.Context) (int64, error) {
+		bound, args, err := c.conn.BindNamed(query, arg)
+		if err != nil {
+			return -1, err
+		}
+		rows, err = c.conn.QueryxContext(ctx, bound, args...)
+		return -1, err
+	})
+	return rows, err
+}
+
+func (c *instrumentedConn) GetContext(ctx context.Context, dest interface{}, query string, args ...interface{}) error {
+	return c.observe(ctx, query, args, func(ctx context.Context) (int64, error) {
+		return -1, c.conn.GetContext(ctx, dest, query, args...)
+	})
+}
+
+func (c *instrumentedConn) SelectContext(ctx context.Context, dest interface{}, query string, args ...interface{}) error {
+	return c.observe(ctx, query, args, func(ctx context.Context) (int64, error) {
+		return -1, c.conn.SelectContext(ctx, dest, query, args...)
+	})
+}
+
+func (c *instrumentedConn) QueryContext(ctx context.Context, query string, args ...interface{}) (*sql.Rows, error) {
+	var rows *sql.Rows
+	err := c.observe(ctx, query, args, func(ctx context.Context) (int64, error) {
+		var err error
+		rows, err = c.conn.QueryContext(ctx, query, args...)
+		return -1, err
+	})
+	return rows, err
+}
+
+func (c *instrumentedConn) QueryRowContext(ctx context.Context, query string, args ...interface{}) *sql.Row {
+	var row *sql.Row
+	_ = c.observe(ctx, query, args, func(ctx context.Context) (int64, error) {
+		row = c.conn.QueryRowContext(ctx, query, args...)
+		return -1, row.Err()
+	})
+	return row
+}
+
+func (c *instrumentedConn) QueryxContext(ctx context.Context, query string, args ...interface{}) (*sqlx.Rows, error) {
+	var rows *sqlx.Rows
+	err := c.observe(ctx, query, args, func(ctx context.Context) (int64, error) {
+		var err error
+		rows, err = c.conn.QueryxContext(ctx, query, args...)
+		return -1, err
+	})
+	return rows, err
+}
+
+func (c *instrumentedConn) QueryRowxContext(ctx context.Context, query string, args ...interface{}) *sqlx.Row {
+	var row *sqlx.Row
+	_ = c.observe(ctx, query, args, func(ctx context.Context) (int64, error) {
+		row = c.conn.QueryRowxContext(ctx, query, args...)
+		return -1, row.Err()
+	})
+	return row
+}
+
+// PrepareNamedContext only observes the prepare itself; statements executed
+// later through the returned *sqlx.NamedStmt bypass the hooks.
+func (c *instrumentedConn) PrepareNamedContext(ctx context.Context, query string) (*sqlx.NamedStmt, error) {
+	var stmt *sqlx.NamedStmt
+	err := c.observe(ctx, query, nil, func(ctx context.Context) (int64, error) {
+		var err error
+		stmt, err = c.conn.PrepareNamedContext(ctx, query)
+		return -1, err
+	})
+	return stmt, err
+}
+
+// PreparexContext only observes the prepare itself; statements executed later
+// through the returned *sqlx.Stmt bypass the hooks.
+func (c *instrumentedConn) PreparexContext(ctx context.Context, query string) (*sqlx.Stmt, error) {
+	var stmt *sqlx.Stmt
+	err := c.observe(ctx, query, nil, func(ctx context.Context) (int64, error) {
+		var err error
+		stmt, err = c.conn.PreparexContext(ctx, query)
+		return -1, err
+	})
+	return stmt, err
+}
@@ -0,0 +1,256 @@
+package database
+
+import (
+	"context"
+	"fmt"
+	"github.com/jackc/pgx/v4"
+	"go-starter-kit/internal/log"
+	"sync"
+	"time"
+)
+
+const (
+	listenMinBackoff = 500 * time.Millisecond
+	listenMaxBackoff = 30 * time.Second
+)
+
+type Notification struct {
+	Channel string
+	Payload string
+	PID     uint32
+}
+
+type NotificationHandler func(ctx context.Context, n *Notification)
+
+// listener owns one dedicated master connection that LISTENs on every
+// channel with at least one handler. After the connection is lost it
+// reconnects with backoff and LISTENs again on all channels.
+type listener struct {
+	logger log.Logger
+	source string
+
+	mu       sync.Mutex
+	handlers map[string]map[int]NotificationHandler
+	nextID   int
+	// interrupt cancels the current wait so a changed set of channels is
+	// applied right away.
+	interrupt context.CancelFunc
+
+	cancel context.CancelFunc
+	done   chan struct{}
+}
+
+func newListener(logger log.Logger, source string) *listener {
+	ctx, cancel := context.WithCancel(context.Background())
+	l := &listener{
+		logger:   logger.WithPrefix("listen"),
+		source:   source,
+		handlers: make(map[string]map[int]NotificationHandler),
+		cancel:   cancel,
+		done:     make(chan struct{}),
+	}
+	go l.run(ctx)
+	return l
+}
+
+// Listen calls handler for every notification on channel until the returned
+// unlisten func is called. Handlers run one at a time on the listener
+// goroutine and should hand long work off elsewhere.
+func (p *Postgres) Listen(channel string, handler NotificationHandler) (unlisten func()) {
+	p.listenerOnce.Do(func() {
+		p.listener = newListener(p.logger, p.masterInfo.source())
+	})
+	if p.listener == nil {
+		// Shutdown already ran.
+		return func() {}
+	}
+	return p.listener.add(channel, handler)
+}
+
+// Subscribe delivers notifications on channel to the returned Go channel,
+// which is closed by unsubscribe. Notifications are dropped, with a warning,
+// while the channel buffer is full.
+func (p *Postgres) Subscribe(channel string, buffer int) (<-chan *Notification, func()) {
+	var (
+		mu     sync.Mutex
+		closed bool
+	)
+	ch := make(chan *Notification, buffer)
+	unlisten := p.Listen(channel, func(ctx context.Context, n *Notification) {
+		mu.Lock()
+		defer mu.Unlock()
+		if closed {
+			return
+		}
+		select {
+		case ch <- n:
+		default:
+			p.logger.Warnf("postgres: subscriber buffer of %s full, notification dropped", channel)
+		}
+	})
+
+	var once sync.Once
+	return ch, func() {
+		once.Do(func() {
+			unlisten()
+			mu.Lock()
+			closed = true
+			close(ch)
+			mu.Unlock()
+		})
+	}
+}
+
+func (l *listener) add(channel string, handler NotificationHandler) func() {
+	l.mu.Lock()
+	id := l.nextID
+	l.nextID++
+	if l.handlers[channel] == nil {
+		l.handlers[channel] = make(map[int]NotificationHandler)
+	}
+	l.handlers[channel][id] = handler
+	l.wakeLocked()
+	l.mu.Unlock()
+
+	return func() {
+		l.mu.Lock()
+		defer l.mu.Unlock()
+		delete(l.handlers[channel], id)
+		if len(l.handlers[channel]) == 0 {
+			delete(l.handlers, channel)
+		}
+		l.wakeLocked()
+	}
+}
+
+func (l *listener) wakeLocked() {
+	if l.interrupt != nil {
+		l.interrupt()
+	}
+}
+
+func (l *listener) stop() {
+	l.cancel()
+	<-l.done
+}
+
+func (l *listener) run(ctx context.Context) {
+	defer close(l.done)
+
+	var conn *pgx.Conn
+	listening := make(map[string]bool)
+	backoff := listenMinBackoff
+	defer func() {
+		if conn != nil {
+			_ = conn.Close(context.Background())
+		}
+	}()
+
+	for ctx.Err() == nil {
+		if conn == nil {
+			c, err := l.connect(ctx)
+			if err != nil {
+				l.logger.Warnf("connect failed, retrying in %s: %s", backoff, err)
+				if !sleepCtx(ctx, backoff) {
+					return
+				}
+				backoff = min(backoff*2, listenMaxBackoff)
+				continue
+			}
+			conn, backoff = c, listenMinBackoff
+			listening = make(map[string]bool)
+		}
+
+		l.mu.Lock()
+		waitCtx, interrupt := context.WithCancel(ctx)
+		l.interrupt = interrupt
+		wanted := make(map[string]bool, len(l.handlers))
+		for channel := range l.handlers {
+			wanted[channel] = true
+		}
+		l.mu.Unlock()
+
+		err := syncChannels(ctx, conn, listening, wanted)
+		if err == nil {
+			var n *Notification
+			n, err = waitForNotification(waitCtx, conn)
+			if n != nil {
+				l.dispatch(ctx, n)
+			}
+		}
+		interrupt()
+
+		if err == nil || ctx.Err() != nil {
+			continue
+		}
+		if waitCtx.Err() != nil && !conn.IsClosed() {
+			// Interrupted because the set of channels changed.
+			continue
+		}
+		l.logger.Warnf("connection lost, reconnecting: %s", err)
+		_ = conn.Close(context.Background())
+		conn = nil
+	}
+}
+
+func (l *listener) connect(ctx context.Context) (*pgx.Conn, error) {
+	conf, err := pgx.ParseConfig(l.source)
+	if err != nil {
+		return nil, fmt.Errorf("pgx parse config failed: %w", err)
+	}
+	return pgx.ConnectConfig(ctx, conf)
+}
+
+func (l *listener) dispatch(ctx context.Context, n *Notification) {
+	l.mu.Lock()
+	handlers := make([]NotificationHandler, 0, len(l.handlers[n.Channel]))
+	for _, handler := range l.handlers[n.Channel] {
+		handlers = append(handlers, handler)
+	}
+	l.mu.Unlock()
+
+	for _, handler := range handlers {
+		handler(ctx, n)
+	}
+}
+
+func syncChannels(ctx context.Context, conn *pgx.Conn, listening, wanted map[string]bool) error {
+	for channel := range wanted {
+		if listening[channel] {
+			continue
+		}
+		if _, err := conn.Exec(ctx, "LISTEN "+pgx.Identifier{channel}.Sanitize()); err != nil {
+			return err
+		}
+		listening[channel] = true
+	}
+	for channel := range listening {
+		if wanted[channel] {
+			continue
+		}
+		if _, err := conn.Exec(ctx, "UNLISTEN "+pgx.Identifier{channel}.Sanitize()); err != nil {
+			return err
+		}
+		delete(listening, channel)
+	}
+	return nil
+}
+
+func waitForNotification(ctx context.Context, conn *pgx.Conn) (*Notification, error) {
+	n, err := conn.WaitForNotification(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return &Notification{Channel: n.Channel, Payload: n.Payload, PID: n.PID}, nil
+}
+
+func sleepCtx(ctx context.Context, d time.Duration) bool {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-ctx.Done():
+		return false
+	case <-timer.C:
+		return true
+	}
+}
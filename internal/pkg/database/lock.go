@@ -0,0 +1,224 @@
+package database
+
+import (
+	"context"
+	"database/sql/driver"
+	"errors"
+	"fmt"
+	"github.com/jmoiron/sqlx"
+	"hash/fnv"
+	"sync"
+	"time"
+)
+
+type LockScope int
+
+const (
+	// SessionLock is held on a dedicated connection until Unlock, the end of
+	// the surrounding transaction scope or Shutdown, whichever comes first.
+	SessionLock LockScope = iota
+	// TransactionLock is taken inside the request transaction and released
+	// by Postgres when it commits or rolls back.
+	TransactionLock
+)
+
+const (
+	lockMinPoll        = 50 * time.Millisecond
+	lockMaxPoll        = time.Second
+	lockReleaseTimeout = 5 * time.Second
+)
+
+var ErrLockNotAcquired = errors.New("advisory lock held by another session")
+
+// LockKey hashes name into the bigint key space of advisory locks.
+func LockKey(name string) int64 {
+	h := fnv.New64a()
+	_, _ = h.Write([]byte(name))
+	return int64(h.Sum64())
+}
+
+type Lock struct {
+	p     *Postgres
+	name  string
+	key   int64
+	scope LockScope
+
+	// conn is the session holding a SessionLock, nil for a TransactionLock.
+	conn *sqlx.Conn
+	once sync.Once
+	err  error
+}
+
+func (l *Lock) Name() string {
+	return l.name
+}
+
+func (l *Lock) Scope() LockScope {
+	return l.scope
+}
+
+// TryLock takes the advisory lock for name without waiting and returns
+// ErrLockNotAcquired when another session holds it.
+func (p *Postgres) TryLock(ctx context.Context, name string, scope LockScope) (*Lock, error) {
+	return p.lock(ctx, name, scope, false)
+}
+
+// Lock waits for the advisory lock for name until ctx is done. Bound the
+// wait with context.WithTimeout.
+func (p *Postgres) Lock(ctx context.Context, name string, scope LockScope) (*Lock, error) {
+	return p.lock(ctx, name, scope, true)
+}
+
+func (p *Postgres) lock(ctx context.Context, name string, scope LockScope, wait bool) (*Lock, error) {
+	// Advisory locks are per database and schema-per-tenant tenants share
+	// one, so the tenant is part of the key. forTenant returns p itself for
+	// those, so the lock is taken right here rather than handed off.
+	if tenant, ok := TenantFromCtx(ctx); ok && p.tenants != nil {
+		tp, err := p.forTenant(ctx)
+		if err != nil {
+			return nil, fmt.Errorf("lock %s: %w", name, err)
+		}
+		p, name = tp, tenant+"/"+name
+	}
+	l := &Lock{p: p, name: name, key: LockKey(name), scope: scope}
+	switch scope {
+	case SessionLock:
+		if err := l.lockSession(ctx, wait); err != nil {
+			return nil, err
+		}
+	case TransactionLock:
+		if err := l.lockTransaction(ctx, wait); err != nil {
+			return nil, err
+		}
+	default:
+		return nil, fmt.Errorf("unknown lock scope %d", scope)
+	}
+	return l, nil
+}
+
+func (l *Lock) lockSession(ctx context.Context, wait bool) error {
+	conn, err := l.p.writeDB.Connx(ctx)
+	if err != nil {
+		return fmt.Errorf("lock %s: get connection failed: %w", l.name, err)
+	}
+
+	// Polling pg_try_advisory_lock rather than blocking in pg_advisory_lock
+	// keeps a cancelled wait from leaving an unknown lock state behind.
+	poll := lockMinPoll
+	for {
+		var acquired bool
+		if err := conn.GetContext(ctx, &acquired, "SELECT pg_try_advisory_lock($1)", l.key); err != nil {
+			discardConn(conn)
+			return fmt.Errorf("lock %s failed: %w", l.name, err)
+		}
+		if acquired {
+			break
+		}
+		if !wait {
+			_ = conn.Close()
+			return ErrLockNotAcquired
+		}
+		if !sleepCtx(ctx, poll) {
+			_ = conn.Close()
+			return fmt.Errorf("lock %s: %w", l.name, ctx.Err())
+		}
+		poll = min(poll*2, lockMaxPoll)
+	}
+
+	l.conn = conn
+	l.p.trackLock(l)
+
+	// Inside a transaction scope the lock goes with it, so a job wrapped in
+	// Begin/EndCtx cannot leak the lock by forgetting Unlock.
+	if transactionCtx, ok := ctx.Value(TransactionCtxKey).(*TransactionCtx); ok && transactionCtx != nil {
+		transactionCtx.OnCommit(func(ctx context.Context) { _ = l.Unlock() })
+		transactionCtx.OnRollback(func(ctx context.Context, err error) { _ = l.Unlock() })
+	}
+	return nil
+}
+
+func (l *Lock) lockTransaction(ctx context.Context, wait bool) error {
+	transactionCtx, ok := ctx.Value(TransactionCtxKey).(*TransactionCtx)
+	if !ok || transactionCtx == nil {
+		return ErrNoTransactionCtx
+	}
+	conn, err := l.p.GetWriteConnection(ctx)
+	if err != nil {
+		return err
+	}
+
+	query := "SELECT pg_try_advisory_xact_lock($1)"
+	if wait {
+		// Waiting inside the transaction is safe: a cancelled wait aborts the
+		// transaction, which rolls back together with any lock state.
+		query = "SELECT true FROM pg_advisory_xact_lock($1)"
+	}
+	var acquired bool
+	if err := conn.GetContext(ctx, &acquired, query, l.key); err != nil {
+		return fmt.Errorf("lock %s failed: %w", l.name, err)
+	}
+	if !acquired {
+		return ErrLockNotAcquired
+	}
+	return nil
+}
+
+// Unlock releases a SessionLock and returns its connection to the pool. It is
+// safe to call more than once. A TransactionLock cannot be released early, so
+// Unlock is a no-op for it.
+func (l *Lock) Unlock() error {
+	if l.scope != SessionLock {
+		return nil
+	}
+	l.once.Do(func() {
+		l.p.untrackLock(l)
+
+		ctx, cancel := context.WithTimeout(context.Background(), lockReleaseTimeout)
+		defer cancel()
+		if _, err := l.conn.ExecContext(ctx, "SELECT pg_advisory_unlock($1)", l.key); err != nil {
+			// Dropping the session releases the lock as well.
+			discardConn(l.conn)
+			l.err = fmt.Errorf("unlock %s failed: %w", l.name, err)
+			l.p.logger.Warnf("postgres: %s", l.err)
+			return
+		}
+		_ = l.conn.Close()
+	})
+	return l.err
+}
+
+func (p *Postgres) trackLock(l *Lock) {
+	p.locksMu.Lock()
+	defer p.locksMu.Unlock()
+	if p.locks == nil {
+		p.locks = make(map[*Lock]struct{})
+	}
+	p.locks[l] = struct{}{}
+}
+
+func (p *Postgres) untrackLock(l *Lock) {
+	p.locksMu.Lock()
+	defer p.locksMu.Unlock()
+	delete(p.locks, l)
+}
+
+func (p *Postgres) releaseLocks() {
+	p.locksMu.Lock()
+	locks := make([]*Lock, 0, len(p.locks))
+	for l := range p.locks {
+		locks = append(locks, l)
+	}
+	p.locksMu.Unlock()
+
+	for _, l := range locks {
+		p.logger.Warnf("postgres: releasing advisory lock %s still held at shutdown", l.name)
+		_ = l.Unlock()
+	}
+}
+
+// discardConn closes the session behind conn instead of returning it to the
+// pool, which also drops any advisory locks it holds.
+func discardConn(conn *sqlx.Conn) {
+	_ = conn.Raw(func(any) error { return driver.ErrBadConn })
+	_ = conn.Close()
+}
@@ -0,0 +1,137 @@
+package database
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/jackc/pgconn"
+	"github.com/jackc/pgx/v4"
+	"github.com/jackc/pgx/v4/pgxpool"
+	"github.com/jackc/pgx/v4/stdlib"
+	"github.com/jmoiron/sqlx"
+)
+
+const (
+	StdlibDriver  = "stdlib"
+	PgxpoolDriver = "pgxpool"
+)
+
+// ErrNativeUnsupported is returned when the database/sql connection is not
+// backed by pgx, so there is no native connection to hand out.
+var ErrNativeUnsupported = errors.New("native pgx connection not available")
+
+// NativeConn is the pgx API shared by *pgxpool.Pool, *pgx.Conn and pgx.Tx:
+// batches, COPY and pgx native types, none of which database/sql exposes.
+type NativeConn interface {
+	Exec(ctx context.Context, sql string, args ...interface{}) (pgconn.CommandTag, error)
+	Query(ctx context.Context, sql string, args ...interface{}) (pgx.Rows, error)
+	QueryRow(ctx context.Context, sql string, args ...interface{}) pgx.Row
+	SendBatch(ctx context.Context, b *pgx.Batch) pgx.BatchResults
+	CopyFrom(ctx context.Context, tableName pgx.Identifier, columnNames []string, rowSrc pgx.CopyFromSource) (int64, error)
+}
+
+// connectNative opens a pgxpool for inf. With lazy set it does not dial until
+// the first connection is acquired.
+func connectNative(inf connectionInfo, lazy bool) (*pgxpool.Pool, error) {
+	conf, err := inf.poolConfig()
+	if err != nil {
+		return nil, err
+	}
+	if inf.MaxOpen > 0 {
+		conf.MaxConns = int32(inf.MaxOpen)
+	}
+	if inf.MaxLifetime > 0 {
+		conf.MaxConnLifetime = inf.MaxLifetime
+	}
+	if inf.MaxIdleTime > 0 {
+		conf.MaxConnIdleTime = inf.MaxIdleTime
+	}
+	conf.LazyConnect = lazy
+
+	timeout := inf.ConnectTimeout
+	if timeout <= 0 {
+		timeout = defaultConnectTimeout
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	pool, err := pgxpool.ConnectConfig(ctx, conf)
+	if err != nil {
+		return nil, fmt.Errorf("pgxpool connect failed: %w", err)
+	}
+	if lazy {
+		return pool, nil
+	}
+	if err := pool.Ping(ctx); err != nil {
+		pool.Close()
+		return nil, fmt.Errorf("pig to database failed: %w", err)
+	}
+	return pool, nil
+}
+
+// WithNativeReadConnection runs fn on a pgx connection chosen like
+// GetReadConnection. Inside an open request transaction fn runs in that
+// transaction, on the same session the Conn API uses. conn must not be used
+// after fn returns.
+func (p *Postgres) WithNativeReadConnection(ctx context.Context, fn func(conn NativeConn) error) error {
+	p, err := p.forTenant(ctx)
+	if err != nil {
+		return fmt.Errorf("can't get database read connection: %w", err)
+	}
+	route, err := p.routeRead(ctx)
+	if err != nil {
+		return fmt.Errorf("can't get database read connection: %w", err)
+	}
+	switch {
+	case route.tx != nil:
+		return route.transactionCtx.rawRead(fn)
+	case route.replica != nil:
+		return withNative(ctx, route.replica.db, route.replica.native, fn)
+	default:
+		return withNative(ctx, p.writeDB, p.writeNative, fn)
+	}
+}
+
+// WithNativeWriteConnection runs fn on a pgx connection chosen like
+// GetWriteConnection, lazily opening the request transaction.
+func (p *Postgres) WithNativeWriteConnection(ctx context.Context, fn func(conn NativeConn) error) error {
+	p, err := p.forTenant(ctx)
+	if err != nil {
+		return fmt.Errorf("can't get database write connection: %w", err)
+	}
+	if transactionCtx, ok := ctx.Value(TransactionCtxKey).(*TransactionCtx); ok && transactionCtx != nil {
+		if _, err := transactionCtx.begin(ctx, p.writeDB, p.setupSession); err != nil {
+			return fmt.Errorf("can't get database write connection: %w", err)
+		}
+		transactionCtx.markWrite()
+		return transactionCtx.raw(fn)
+	}
+	if p.needsSession(ctx) {
+		return fmt.Errorf("can't get database write connection: %w", ErrSessionNeedsTx)
+	}
+	return withNative(ctx, p.writeDB, p.writeNative, fn)
+}
+
+// withNative prefers the pgxpool when the pgxpool driver is selected and
+// otherwise borrows a connection from the database/sql pool.
+func withNative(ctx context.Context, db *sqlx.DB, pool *pgxpool.Pool, fn func(conn NativeConn) error) error {
+	if pool != nil {
+		return fn(pool)
+	}
+	conn, err := db.Connx(ctx)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	return rawConn(conn, fn)
+}
+
+func rawConn(conn *sqlx.Conn, fn func(conn NativeConn) error) error {
+	return conn.Raw(func(driverConn interface{}) error {
+		c, ok := driverConn.(*stdlib.Conn)
+		if !ok {
+			return fmt.Errorf("%w: driver connection is %T", ErrNativeUnsupported, driverConn)
+		}
+		return fn(c.Conn())
+	})
+}
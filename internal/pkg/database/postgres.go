@@ -3,176 +3,610 @@ package database
 import (
 	"context"
 	"database/sql"
-	"errors"
 	"fmt"
 	"github.com/jackc/pgx/v4/pgxpool"
 	"github.com/jackc/pgx/v4/stdlib"
 	"github.com/jmoiron/sqlx"
 	"go-starter-kit/internal/log"
 	"go-starter-kit/internal/server/config"
+	"net"
 	"net/url"
+	"sync"
+	"time"
+)
+
+const (
+	defaultHealthCheckInterval = 5 * time.Second
+	defaultHealthCheckTimeout  = 2 * time.Second
+	defaultConnectTimeout      = 10 * time.Second
 )
 
 type Postgres struct {
-	writeDB *sqlx.DB
-	readDB  *sqlx.DB
+	logger      log.Logger
+	masterInfo  connectionInfo
+	writeDB     *sqlx.DB
+	writeNative *pgxpool.Pool
+	// writeBreaker guards master, which also serves reads inside
+	// transactions and reads that fall back from the replicas.
+	writeBreaker *breaker
+	replicas     []*replica
+	balancer     balancer
+
+	listener     *listener
+	listenerOnce sync.Once
+
+	locksMu sync.Mutex
+	locks   map[*Lock]struct{}
+
+	hooksMu sync.RWMutex
+	hooks   []QueryHook
+
+	// tenants is nil unless tenancy is enabled.
+	tenants *tenantRegistry
+
+	healthCheckTimeout time.Duration
+	maxReplicationLag  time.Duration
+	retry              retryPolicy
+	sessionVars        *sessionVariables
+
+	done chan struct{}
+	wg   sync.WaitGroup
 }
 
+// Conn is the connection handed out by GetReadConnection and
+// GetWriteConnection. Every statement takes a context, so request deadlines
+// and cancellation reach Postgres.
 type Conn interface {
 	BindNamed(query string, arg interface{}) (string, []interface{}, error)
 	DriverName() string
-	Get(dest interface{}, query string, args ...interface{}) error
-	GetContext(ctx context.Context, dest interface{}, query string, args ...interface{}) error
-	MustExec(query string, args ...interface{}) sql.Result
+	Rebind(query string) string
+
+	ExecContext(ctx context.Context, query string, args ...interface{}) (sql.Result, error)
 	MustExecContext(ctx context.Context, query string, args ...interface{}) sql.Result
-	NamedExec(query string, arg interface{}) (sql.Result, error)
 	NamedExecContext(ctx context.Context, query string, arg interface{}) (sql.Result, error)
-	NamedQuery(query string, arg interface{}) (*sqlx.Rows, error)
-	PrepareNamed(query string) (*sqlx.NamedStmt, error)
+	NamedQueryContext(ctx context.Context, query string, arg interface{}) (*sqlx.Rows, error)
+	GetContext(ctx context.Context, dest interface{}, query string, args ...interface{}) error
+	SelectContext(ctx context.Context, dest interface{}, query string, args ...interface{}) error
+	QueryContext(ctx context.Context, query string, args ...interface{}) (*sql.Rows, error)
+	QueryRowContext(ctx context.Context, query string, args ...interface{}) *sql.Row
+	QueryxContext(ctx context.Context, query string, args ...interface{}) (*sqlx.Rows, error)
+	QueryRowxContext(ctx context.Context, query string, args ...interface{}) *sqlx.Row
 	PrepareNamedContext(ctx context.Context, query string) (*sqlx.NamedStmt, error)
-	Preparex(query string) (*sqlx.Stmt, error)
 	PreparexContext(ctx context.Context, query string) (*sqlx.Stmt, error)
-	QueryRowx(query string, args ...interface{}) *sqlx.Row
-	QueryRowxContext(ctx context.Context, query string, args ...interface{}) *sqlx.Row
-	Queryx(query string, args ...interface{}) (*sqlx.Rows, error)
-	QueryxContext(ctx context.Context, query string, args ...interface{}) (*sqlx.Rows, error)
-	Rebind(query string) string
-	Select(dest interface{}, query string, args ...interface{}) error
-	SelectContext(ctx context.Context, dest interface{}, query string, args ...interface{}) error
-	Exec(query string, args ...interface{}) (sql.Result, error)
-	Query(query string, args ...interface{}) (*sql.Rows, error)
-	QueryRow(query string, args ...interface{}) *sql.Row
 }
 
 type connectionInfo struct {
-	Database string
-	Host     string
-	User     string
-	Password string
-	MaxOpen  int
-	MaxIdle  int
+	Name           string
+	DSN            string
+	Database       string
+	Host           string
+	Port           string
+	User           string
+	Password       string
+	SSLMode        string
+	SSLRootCert    string
+	SSLCert        string
+	SSLKey         string
+	Params         map[string]string
+	SearchPath     string
+	MaxOpen        int
+	NativeMaxOpen  int
+	MaxIdle        int
+	MaxLifetime    time.Duration
+	MaxIdleTime    time.Duration
+	ConnectTimeout time.Duration
+	Weight         int
+}
+
+func newConnectionInfo(name string, inst config.PostgresqlInstance) connectionInfo {
+	if inst.Name != "" {
+		name = inst.Name
+	}
+	return connectionInfo{
+		Name:           name,
+		DSN:            inst.DSN,
+		Database:       inst.DB,
+		Host:           inst.Host,
+		Port:           inst.Port,
+		User:           inst.User,
+		Password:       inst.Password,
+		SSLMode:        inst.SSLMode,
+		SSLRootCert:    inst.SSLRootCert,
+		SSLCert:        inst.SSLCert,
+		SSLKey:         inst.SSLKey,
+		Params:         inst.Params,
+		SearchPath:     inst.SearchPath,
+		MaxOpen:        inst.MaxOpen,
+		NativeMaxOpen:  inst.NativeMaxOpen,
+		MaxIdle:        inst.MaxIdle,
+		MaxLifetime:    time.Duration(inst.MaxLifetime) * time.Second,
+		MaxIdleTime:    time.Duration(inst.MaxIdleTime) * time.Second,
+		ConnectTimeout: time.Duration(inst.ConnectTimeout) * time.Second,
+		Weight:         inst.Weight,
+	}
+}
+
+// source builds the connection string handed to pgx. A configured DSN wins
+// over every other field; otherwise sslmode defaults to disable and Params
+// become runtime parameters such as application_name or statement_timeout.
+func (inf connectionInfo) source() string {
+	if inf.DSN != "" {
+		return inf.DSN
+	}
+
+	query := url.Values{}
+	for k, v := range inf.Params {
+		query.Set(k, v)
+	}
+	sslMode := inf.SSLMode
+	if sslMode == "" {
+		sslMode = "disable"
+	}
+	query.Set("sslmode", sslMode)
+	if inf.SSLRootCert != "" {
+		query.Set("sslrootcert", inf.SSLRootCert)
+	}
+	if inf.SSLCert != "" {
+		query.Set("sslcert", inf.SSLCert)
+	}
+	if inf.SSLKey != "" {
+		query.Set("sslkey", inf.SSLKey)
+	}
+
+	host := inf.Host
+	if inf.Port != "" {
+		host = net.JoinHostPort(host, inf.Port)
+	}
+	source := url.URL{
+		Scheme:   "postgres",
+		User:     url.UserPassword(inf.User, inf.Password),
+		Host:     host,
+		Path:     "/" + inf.Database,
+		RawQuery: query.Encode(),
+	}
+	return source.String()
 }
 
 func NewPostgres(conf *config.Config, logger log.Logger) (*Postgres, error) {
-	masterInfo := connectionInfo{
-		Database: conf.Connection.Postgresql.Master.DB,
-		Host:     conf.Connection.Postgresql.Master.Host,
-		User:     conf.Connection.Postgresql.Master.User,
-		Password: conf.Connection.Postgresql.Master.Password,
-		MaxOpen:  conf.Connection.Postgresql.Master.MaxOpen,
-		MaxIdle:  conf.Connection.Postgresql.Master.MaxIdle,
-	}
-
-	slaveInfo := connectionInfo{
-		Database: conf.Connection.Postgresql.Slave.DB,
-		Host:     conf.Connection.Postgresql.Slave.Host,
-		User:     conf.Connection.Postgresql.Slave.User,
-		Password: conf.Connection.Postgresql.Slave.Password,
-		MaxOpen:  conf.Connection.Postgresql.Slave.MaxOpen,
-		MaxIdle:  conf.Connection.Postgresql.Slave.MaxIdle,
-	}
-
-	var readInfo connectionInfo
-	switch conf.Connection.Postgresql.FixedReadInstance {
-	case "master":
-		readInfo = masterInfo
-	case "slave":
-		readInfo = slaveInfo
+	pgConf := conf.Connection.Postgresql
+	masterInfo := newConnectionInfo("master", pgConf.Master)
+
+	// Replicas takes precedence; FixedReadInstance is kept for configs that
+	// only know about a single master/slave pair.
+	readInfos := make([]connectionInfo, 0, len(pgConf.Replicas))
+	for i, inst := range pgConf.Replicas {
+		readInfos = append(readInfos, newConnectionInfo(fmt.Sprintf("replica-%d", i), inst))
+	}
+	if len(readInfos) == 0 {
+		switch pgConf.FixedReadInstance {
+		case "master":
+			readInfos = append(readInfos, masterInfo)
+		case "slave":
+			readInfos = append(readInfos, newConnectionInfo("slave", pgConf.Slave))
+		default:
+
+		}
+	}
+
+	lb, err := newBalancer(pgConf.LoadBalancer)
+	if err != nil {
+		return nil, err
+	}
+	switch pgConf.Driver {
+	case "", StdlibDriver, PgxpoolDriver:
 	default:
+		return nil, fmt.Errorf("unknown postgres driver %q", pgConf.Driver)
+	}
+	sessionVars, err := newSessionVariables(pgConf.SessionVariables)
+	if err != nil {
+		return nil, err
+	}
 
+	// Master and replicas connect concurrently. Only master is retried:
+	// a replica gets a single attempt, bounded by its connect timeout, and
+	// otherwise starts unhealthy below until the health check sees it
+	// answer, so a dead replica does not hold up startup.
+	startupRetry := newRetryPolicy(pgConf.StartupRetry.MaxAttempts, pgConf.StartupRetry.InitialBackoff,
+		pgConf.StartupRetry.MaxBackoff, startupRetryDefaults)
+	type pools struct {
+		db     *sqlx.DB
+		native *pgxpool.Pool
+		err    error
+	}
+	readPools := make([]pools, len(readInfos))
+	var connecting sync.WaitGroup
+	for i, info := range readInfos {
+		connecting.Add(1)
+		go func(i int, info connectionInfo) {
+			defer connecting.Done()
+			db, native, err := openPools(info, pgConf.Driver, false)
+			readPools[i] = pools{db: db, native: native, err: err}
+		}(i, info)
 	}
+	writeDB, writeNative, err := connectWithRetry(logger, masterInfo, pgConf.Driver, startupRetry)
+	connecting.Wait()
 
-	writeDB, err := connectPostgres(masterInfo)
+	replicas := make([]*replica, 0, len(readInfos))
+	closeAll := func() {
+		if writeDB != nil {
+			_ = writeDB.Close()
+		}
+		if writeNative != nil {
+			writeNative.Close()
+		}
+		for _, r := range replicas {
+			r.close()
+		}
+		for _, rp := range readPools[len(replicas):] {
+			if rp.db != nil {
+				_ = rp.db.Close()
+			}
+			if rp.native != nil {
+				rp.native.Close()
+			}
+		}
+	}
 	if err != nil {
+		closeAll()
 		return nil, fmt.Errorf("can't not open write database connection: %w", err)
 	}
-	readDB, err := connectPostgres(readInfo)
+
+	breakerConf := breakerConfig{
+		failureThreshold: pgConf.CircuitBreaker.FailureThreshold,
+		openTimeout:      time.Duration(pgConf.CircuitBreaker.OpenTimeout) * time.Millisecond,
+		halfOpenRequests: pgConf.CircuitBreaker.HalfOpenRequests,
+	}
+	for i, info := range readInfos {
+		rp := readPools[i]
+		healthy := rp.err == nil
+		if !healthy {
+			// An unreachable replica does not stop the service: it starts
+			// unhealthy, reads go to master and the health check brings it
+			// back once it answers.
+			logger.Warnf("postgres replica %s is unreachable, reading from master until it recovers: %s", info.Name, rp.err)
+			rp.db, rp.native, rp.err = openPools(info, pgConf.Driver, true)
+			if rp.err != nil {
+				closeAll()
+				return nil, fmt.Errorf("can't not open read database connection %s: %w", info.Name, rp.err)
+			}
+		}
+		r := newReplica(info.Name, rp.db, rp.native, info.Weight, newBreaker(info.Name, logger, breakerConf))
+		r.healthy.Store(healthy)
+		replicas = append(replicas, r)
+	}
+
+	timeout := time.Duration(pgConf.HealthCheck.Timeout) * time.Second
+	if timeout <= 0 {
+		timeout = defaultHealthCheckTimeout
+	}
+
+	p := &Postgres{
+		logger:             logger,
+		masterInfo:         masterInfo,
+		writeDB:            writeDB,
+		writeNative:        writeNative,
+		writeBreaker:       newBreaker(masterInfo.Name, logger, breakerConf),
+		replicas:           replicas,
+		balancer:           lb,
+		healthCheckTimeout: timeout,
+		maxReplicationLag:  time.Duration(pgConf.MaxReplicationLag) * time.Millisecond,
+		retry:              newRetryPolicy(pgConf.Retry.MaxAttempts, pgConf.Retry.InitialBackoff, pgConf.Retry.MaxBackoff, txRetryDefaults),
+		sessionVars:        sessionVars,
+		done:               make(chan struct{}),
+	}
+
+	if pgConf.SlowQueryThreshold > 0 {
+		p.AddQueryHook(NewSlowQueryHook(logger, time.Duration(pgConf.SlowQueryThreshold)*time.Millisecond))
+	}
+
+	if len(replicas) > 0 {
+		interval := time.Duration(pgConf.HealthCheck.Interval) * time.Second
+		if interval <= 0 {
+			interval = defaultHealthCheckInterval
+		}
+		p.wg.Add(1)
+		go p.runHealthCheck(interval)
+	}
+
+	if conf.Tenancy.Enabled {
+		if p.tenants, err = newTenantRegistry(p, conf, logger); err != nil {
+			p.Shutdown()
+			return nil, err
+		}
+		p.wg.Add(1)
+		go p.runTenantEviction()
+	}
+
+	return p, nil
+}
+
+// Open connects a standalone pool to one instance, for tools such as the
+// migration runner that need neither replicas nor request transactions.
+func Open(name string, inst config.PostgresqlInstance) (*sqlx.DB, error) {
+	return connectPostgres(newConnectionInfo(name, inst))
+}
+
+// openPools opens the database/sql pool backing the Conn API and, with the
+// pgxpool driver, a native pool next to it for WithNative*Connection. Unless
+// lazy, it pings them and fails when the database cannot be reached.
+func openPools(inf connectionInfo, driver string, lazy bool) (*sqlx.DB, *pgxpool.Pool, error) {
+	sqlInf, nativeInf := inf, inf
+	sqlInf.MaxOpen, nativeInf.MaxOpen = inf.poolSizes(driver)
+
+	db, err := openDB(sqlInf)
+	if err != nil {
+		return nil, nil, err
+	}
+	if !lazy {
+		if err := pingDB(db, inf); err != nil {
+			_ = db.Close()
+			return nil, nil, err
+		}
+	}
+	if driver != PgxpoolDriver {
+		return db, nil, nil
+	}
+	native, err := connectNative(nativeInf, lazy)
 	if err != nil {
-		return nil, fmt.Errorf("can't not open read database connection: %w", err)
+		_ = db.Close()
+		return nil, nil, err
+	}
+	return db, native, nil
+}
+
+// poolSizes splits MaxOpen between the database/sql pool and, with the
+// pgxpool driver, the native pool, so that together they stay within what
+// the instance was given. Each pool gets at least one connection. Without a
+// MaxOpen the database/sql pool is unbounded and the native pool takes
+// NativeMaxOpen, or the pgxpool default when that is zero too.
+func (inf connectionInfo) poolSizes(driver string) (sqlMax, nativeMax int) {
+	if driver != PgxpoolDriver {
+		return inf.MaxOpen, 0
 	}
+	if inf.MaxOpen <= 0 {
+		return 0, inf.NativeMaxOpen
+	}
+	nativeMax = inf.NativeMaxOpen
+	if nativeMax <= 0 {
+		nativeMax = inf.MaxOpen / 4
+	}
+	nativeMax = max(1, min(nativeMax, inf.MaxOpen-1))
+	return max(1, inf.MaxOpen-nativeMax), nativeMax
+}
 
-	return &Postgres{
-		writeDB: writeDB,
-		readDB:  readDB,
-	}, nil
+// connectWithRetry opens the pools of inf, retrying with backoff while the
+// database is unreachable, e.g. because it is still starting next to us.
+func connectWithRetry(logger log.Logger, inf connectionInfo, driver string, policy retryPolicy) (*sqlx.DB, *pgxpool.Pool, error) {
+	for attempt := 1; ; attempt++ {
+		db, native, err := openPools(inf, driver, false)
+		if err == nil {
+			return db, native, nil
+		}
+		if attempt >= policy.maxAttempts {
+			return nil, nil, err
+		}
+		delay := policy.backoff(attempt)
+		logger.Warnf("postgres %s: connect failed, retrying in %s (attempt %d/%d): %s",
+			inf.Name, delay, attempt+1, policy.maxAttempts, err)
+		time.Sleep(delay)
+	}
 }
 
 func connectPostgres(inf connectionInfo) (*sqlx.DB, error) {
-	source := fmt.Sprintf("postgres://%s:%s@%s/%s?sslmode=disable", url.QueryEscape(inf.User),
-		url.QueryEscape(inf.Password), inf.Host, inf.Database)
-	fmt.Println(source)
-	conf, err := pgxpool.ParseConfig(source)
+	DB, err := openDB(inf)
+	if err != nil {
+		return nil, err
+	}
+	if err := pingDB(DB, inf); err != nil {
+		_ = DB.Close()
+		return nil, err
+	}
+	return DB, nil
+}
+
+// poolConfig parses inf into a pgx config. SearchPath is applied here rather
+// than in source so it also holds for a DSN override.
+func (inf connectionInfo) poolConfig() (*pgxpool.Config, error) {
+	conf, err := pgxpool.ParseConfig(inf.source())
 	if err != nil {
 		return nil, fmt.Errorf("pgx parse config failed: %w", err)
 	}
+	if inf.ConnectTimeout > 0 {
+		conf.ConnConfig.ConnectTimeout = inf.ConnectTimeout
+	}
+	if inf.SearchPath != "" {
+		conf.ConnConfig.RuntimeParams["search_path"] = inf.SearchPath
+	}
+	return conf, nil
+}
+
+// openDB sets up the pool of inf without connecting; database/sql dials on
+// first use.
+func openDB(inf connectionInfo) (*sqlx.DB, error) {
+	conf, err := inf.poolConfig()
+	if err != nil {
+		return nil, err
+	}
 
 	db := stdlib.OpenDB(*conf.ConnConfig)
 
 	DB := sqlx.NewDb(db, "pgx")
-	if err := DB.Ping(); err != nil {
-		return nil, fmt.Errorf("pig to database failed: %w", err)
-	}
-
 	DB.SetMaxOpenConns(inf.MaxOpen)
 	DB.SetMaxIdleConns(inf.MaxIdle)
+	DB.SetConnMaxLifetime(inf.MaxLifetime)
+	DB.SetConnMaxIdleTime(inf.MaxIdleTime)
+	return DB, nil
+}
 
-	return DB, err
+func pingDB(DB *sqlx.DB, inf connectionInfo) error {
+	pingTimeout := inf.ConnectTimeout
+	if pingTimeout <= 0 {
+		pingTimeout = defaultConnectTimeout
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), pingTimeout)
+	defer cancel()
+	if err := DB.PingContext(ctx); err != nil {
+		return fmt.Errorf("pig to database failed: %w", err)
+	}
+	return nil
 }
 
-func (p *Postgres) GetReadConnection(ctx context.Context) (Conn, error) {
-	if transactionCtx, ok := ctx.Value(TransactionCtxKey).(*TransactionCtx); ok {
-		conn := transactionCtx.Conn
-		if conn != nil {
-			return conn, nil
+// readRoute is where a read goes: a transaction when tx is set, a replica,
+// or master when both are nil. The transaction is on replica when that is
+// set and on master otherwise.
+type readRoute struct {
+	transactionCtx *TransactionCtx
+	tx             *sqlx.Tx
+	replica        *replica
+}
+
+func (p *Postgres) routeRead(ctx context.Context) (readRoute, error) {
+	needsSession := p.needsSession(ctx)
+	if transactionCtx, ok := ctx.Value(TransactionCtxKey).(*TransactionCtx); ok && transactionCtx != nil {
+		if conn := transactionCtx.current(); conn != nil {
+			return readRoute{transactionCtx: transactionCtx, tx: conn}, nil
+		}
+		// Declared options mean the whole request runs in one transaction,
+		// reads included, so open it here rather than wait for a write.
+		if transactionCtx.wantsTx() {
+			conn, err := transactionCtx.begin(ctx, p.writeDB, p.setupSession)
+			if err != nil {
+				return readRoute{}, err
+			}
+			return readRoute{transactionCtx: transactionCtx, tx: conn}, nil
+		}
+		// A session to set up needs a transaction too, as a pooled
+		// connection would have neither the tenant's search_path nor the
+		// session variables. Reads get a read-only one where they would go
+		// anyway, so a replica serves them all the same.
+		if needsSession {
+			primary := transactionCtx.Committed() || p.readsFromPrimary(ctx)
+			conn, r, err := transactionCtx.beginRead(ctx, func() (*sqlx.DB, *replica, error) {
+				return p.pickRead(primary)
+			}, p.setupSession)
+			if err != nil {
+				return readRoute{}, err
+			}
+			return readRoute{transactionCtx: transactionCtx, tx: conn, replica: r}, nil
+		}
+		if transactionCtx.Committed() {
+			return readRoute{}, nil
 		}
 	}
+	if needsSession {
+		return readRoute{}, ErrSessionNeedsTx
+	}
+	if p.readsFromPrimary(ctx) {
+		return readRoute{}, nil
+	}
+	return readRoute{replica: p.pickReplica()}, nil
+}
+
+// readsFromPrimary reports whether reads of ctx must see master's latest
+// writes: after a job's transaction committed or within the sticky window.
+func (p *Postgres) readsFromPrimary(ctx context.Context) bool {
+	customSettingCtx, ok := ctx.Value(CustomSettingCtxKey).(*CustomSettingCtx)
+	return ok && (customSettingCtx.IsJobAfterTxCommit || customSettingCtx.StickyPrimary)
+}
 
-	if customSettingCtx, ok := ctx.Value(CustomSettingCtxKey).(*CustomSettingCtx); ok {
-		if customSettingCtx.IsJobAfterTxCommit {
-			return p.writeDB, nil
+// pickRead returns the pool a read-only transaction opens on: a replica like
+// for a plain read unless primary, master otherwise.
+func (p *Postgres) pickRead(primary bool) (*sqlx.DB, *replica, error) {
+	if !primary {
+		if r := p.pickReplica(); r != nil {
+			return r.db, r, nil
 		}
 	}
-	return p.readDB, nil
+	if !p.writeBreaker.allow() {
+		return nil, nil, ErrCircuitOpen
+	}
+	return p.writeDB, nil, nil
 }
 
-func (p *Postgres) GetWriteConnection(ctx context.Context) (Conn, error) {
-	if transactionCtx, ok := ctx.Value(TransactionCtxKey).(*TransactionCtx); ok {
-		if transactionCtx == nil {
-			transactionCtx.Mu.Lock()
-			defer transactionCtx.Mu.Unlock()
+func (p *Postgres) GetReadConnection(ctx context.Context) (Conn, error) {
+	p, err := p.forTenant(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("can't get database read connection: %w", err)
+	}
+	route, err := p.routeRead(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("can't get database read connection: %w", err)
+	}
+	switch {
+	case route.tx != nil && route.replica != nil:
+		return p.instrument(route.tx, route.replica.name, true, route.replica.breaker), nil
+	case route.tx != nil:
+		return p.instrument(route.tx, p.masterInfo.Name, true, p.writeBreaker), nil
+	case route.replica != nil:
+		return p.instrument(route.replica.db, route.replica.name, false, route.replica.breaker), nil
+	case !p.writeBreaker.allow():
+		return nil, fmt.Errorf("can't get database read connection: %w", ErrCircuitOpen)
+	default:
+		return p.instrument(p.writeDB, p.masterInfo.Name, false, p.writeBreaker), nil
+	}
+}
 
-			conn, err := p.writeDB.Beginx()
-			if err != nil {
-				return nil, fmt.Errorf("can't get database write connection: %w", err)
-			}
-			transactionCtx.Conn = conn
+func (p *Postgres) GetWriteConnection(ctx context.Context) (Conn, error) {
+	p, err := p.forTenant(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("can't get database write connection: %w", err)
+	}
+	transactionCtx, ok := ctx.Value(TransactionCtxKey).(*TransactionCtx)
+	inTx := ok && transactionCtx != nil
+	// A running transaction keeps its session whatever the breaker says.
+	if (!inTx || !transactionCtx.Active()) && !p.writeBreaker.allow() {
+		return nil, fmt.Errorf("can't get database write connection: %w", ErrCircuitOpen)
+	}
+	if inTx {
+		conn, err := transactionCtx.begin(ctx, p.writeDB, p.setupSession)
+		if err != nil {
+			return nil, fmt.Errorf("can't get database write connection: %w", err)
 		}
-		return transactionCtx.Conn, nil
+		transactionCtx.markWrite()
+		return p.instrument(conn, p.masterInfo.Name, true, p.writeBreaker), nil
+	}
+	if p.needsSession(ctx) {
+		return nil, fmt.Errorf("can't get database write connection: %w", ErrSessionNeedsTx)
 	}
-	return p.writeDB, nil
+	return p.instrument(p.writeDB, p.masterInfo.Name, false, p.writeBreaker), nil
 }
 
-func (p *Postgres) Ping() error {
+// Ping checks master only. Replicas are checked by the background health
+// check and Status reports its last result: a failing replica does not make
+// the service unready, reads fall back to the remaining replicas or master.
+func (p *Postgres) Ping(ctx context.Context) error {
 	if p.writeDB != nil {
-		if err := p.writeDB.Ping(); err != nil {
+		if err := p.writeDB.PingContext(ctx); err != nil {
 			return fmt.Errorf("postgres write pig failed: %w", err)
 		}
 	}
-
-	if p.readDB != nil {
-		if err := p.readDB.Ping(); err != nil {
-			return fmt.Errorf("postgres read pig failed: %w", err)
-		}
-	}
 	return nil
 }
 
 func (p *Postgres) Shutdown() {
+	close(p.done)
+	p.wg.Wait()
+
+	if p.tenants != nil {
+		p.tenants.shutdown()
+	}
+
+	// Claim the once so a Listen racing with Shutdown cannot start a new
+	// listener after this point.
+	p.listenerOnce.Do(func() {})
+	if p.listener != nil {
+		p.listener.stop()
+	}
+	p.releaseLocks()
+
 	if p.writeDB != nil {
 		_ = p.writeDB.Close()
 	}
-	if p.readDB != nil {
-		_ = p.readDB.Close()
+	if p.writeNative != nil {
+		p.writeNative.Close()
+	}
+	for _, r := range p.replicas {
+		r.close()
 	}
 }
 
@@ -182,17 +616,43 @@ func (p *Postgres) InitCtx() (context.Context, context.CancelFunc) {
 	return ctx, cancel
 }
 
+// Begin opens a transaction scope for service code and must be paired with
+// EndCtx on the returned context. Outside any transaction it behaves like
+// InitCtx on top of ctx: the transaction is opened by the first write. Inside
+// one it starts the outer transaction if needed and creates a SAVEPOINT, so
+// the inner EndCtx releases or rolls back to that savepoint and only the
+// outermost EndCtx commits.
+func (p *Postgres) Begin(ctx context.Context) (context.Context, error) {
+	outer, ok := ctx.Value(TransactionCtxKey).(*TransactionCtx)
+	if !ok || outer == nil {
+		return context.WithValue(ctx, TransactionCtxKey, &TransactionCtx{}), nil
+	}
+	p, err := p.forTenant(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("can't get database write connection: %w", err)
+	}
+	if _, err := outer.begin(ctx, p.writeDB, p.setupSession); err != nil {
+		return nil, fmt.Errorf("can't get database write connection: %w", err)
+	}
+	inner, err := outer.nest(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("create savepoint failed: %w", err)
+	}
+	return context.WithValue(ctx, TransactionCtxKey, inner), nil
+}
+
+// EndCtx commits the transaction opened under ctx, or rolls it back when err
+// is non-nil. For a context returned by a nested Begin this releases or rolls
+// back to its savepoint instead. Called directly by defer it also rolls back
+// on panic and then re-panics.
 func (p *Postgres) EndCtx(ctx context.Context, err error) error {
-	if transactionCtx, ok := ctx.Value(TransactionCtxKey).(*TransactionCtx); ok {
-		if tx := transactionCtx.Conn; tx != nil {
-			if p := recover(); p != nil {
-				return tx.Rollback()
-			} else if err != nil {
-				return tx.Rollback()
-			} else {
-				return tx.Commit()
-			}
-		}
+	transactionCtx, ok := ctx.Value(TransactionCtxKey).(*TransactionCtx)
+	if !ok || transactionCtx == nil {
+		return ErrNoTransactionCtx
+	}
+	if r := recover(); r != nil {
+		_ = transactionCtx.End(ctx, fmt.Errorf("panic: %v", r))
+		panic(r)
 	}
-	return errors.New("TransactionCtx Not found")
+	return transactionCtx.End(ctx, err)
 }
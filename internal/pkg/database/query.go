@@ -0,0 +1,365 @@
+package database
+
+import (
+	"errors"
+	"fmt"
+	"github.com/jackc/pgx/v4"
+	"strconv"
+	"strings"
+)
+
+var (
+	ErrUnknownColumn   = errors.New("unknown column")
+	ErrUnknownOperator = errors.New("unknown operator")
+	ErrInvalidQuery    = errors.New("invalid query")
+)
+
+type Op string
+
+const (
+	OpEq       Op = "eq"
+	OpNe       Op = "ne"
+	OpLt       Op = "lt"
+	OpLte      Op = "lte"
+	OpGt       Op = "gt"
+	OpGte      Op = "gte"
+	OpIn       Op = "in"
+	OpNotIn    Op = "not_in"
+	OpLike     Op = "like"
+	OpILike    Op = "ilike"
+	OpContains Op = "contains"
+	OpIsNull   Op = "is_null"
+	OpNotNull  Op = "not_null"
+)
+
+var comparisonOps = map[Op]string{
+	OpEq:    "=",
+	OpNe:    "<>",
+	OpLt:    "<",
+	OpLte:   "<=",
+	OpGt:    ">",
+	OpGte:   ">=",
+	OpLike:  "LIKE",
+	OpILike: "ILIKE",
+}
+
+// ParseOp validates an operator taken from user input.
+func ParseOp(s string) (Op, error) {
+	op := Op(s)
+	switch op {
+	case OpIn, OpNotIn, OpContains, OpIsNull, OpNotNull:
+		return op, nil
+	}
+	if _, ok := comparisonOps[op]; ok {
+		return op, nil
+	}
+	return "", fmt.Errorf("%w %q", ErrUnknownOperator, s)
+}
+
+// Columns whitelists the columns user input may refer to. Keys are the names
+// clients use, values the column they stand for, optionally table qualified
+// such as "u.created_at".
+type Columns map[string]string
+
+// Filter compares the column named Column with Value. OpIn and OpNotIn take a
+// slice, OpIsNull and OpNotNull ignore Value.
+type Filter struct {
+	Column string
+	Op     Op
+	Value  interface{}
+}
+
+type Sort struct {
+	Column string
+	Desc   bool
+}
+
+// ParseSort reads a sort parameter such as "name,-created_at", where a
+// leading '-' sorts descending. Columns are validated by OrderBy.
+func ParseSort(s string) []Sort {
+	var sorts []Sort
+	for _, part := range strings.Split(s, ",") {
+		part = strings.TrimSpace(part)
+		if part == "" {
+			continue
+		}
+		sort := Sort{Column: part}
+		if strings.HasPrefix(part, "-") {
+			sort = Sort{Column: part[1:], Desc: true}
+		}
+		sorts = append(sorts, sort)
+	}
+	return sorts
+}
+
+// QueryBuilder builds a SELECT from user supplied filters, sorting and
+// pagination. User input only ever selects whitelisted columns and typed
+// operators and all values become $n placeholders, so the result is safe to
+// run on a Conn as is. The first invalid input is reported by Build.
+//
+//	query, args, err := database.NewQuery("users", database.Columns{
+//		"name":      "name",
+//		"createdAt": "created_at",
+//	}).
+//		Select("id", "name", "created_at").
+//		Where(filters...).
+//		OrderBy(database.ParseSort(c.Query("sort"))...).
+//		Limit(20).
+//		Build()
+type QueryBuilder struct {
+	table   string
+	allowed Columns
+	fields  []string
+	// conditions use ? for their arguments, numbered by Build.
+	conditions []string
+	args       []interface{}
+	sorts      []Sort
+	after      []interface{}
+	limit      int
+	offset     int
+	err        error
+}
+
+// NewQuery starts a query on table, optionally schema qualified. It selects
+// every column until Select is called.
+func NewQuery(table string, allowed Columns) *QueryBuilder {
+	return &QueryBuilder{table: quoteIdentifier(table), allowed: allowed}
+}
+
+// Select sets the columns to return. They come from code, not user input,
+// and are quoted as identifiers.
+func (b *QueryBuilder) Select(columns ...string) *QueryBuilder {
+	b.fields = b.fields[:0]
+	for _, column := range columns {
+		b.fields = append(b.fields, quoteIdentifier(column))
+	}
+	return b
+}
+
+func (b *QueryBuilder) Where(filters ...Filter) *QueryBuilder {
+	for _, filter := range filters {
+		column, ok := b.column(filter.Column)
+		if !ok {
+			continue
+		}
+		if err := b.addFilter(column, filter); err != nil {
+			b.fail(err)
+		}
+	}
+	return b
+}
+
+// WhereRaw adds a condition written in code, using ? for each of args.
+func (b *QueryBuilder) WhereRaw(condition string, args ...interface{}) *QueryBuilder {
+	if strings.Count(condition, "?") != len(args) {
+		b.fail(fmt.Errorf("%w: %q expects %d arguments, got %d",
+			ErrInvalidQuery, condition, strings.Count(condition, "?"), len(args)))
+		return b
+	}
+	b.conditions = append(b.conditions, "("+condition+")")
+	b.args = append(b.args, args...)
+	return b
+}
+
+func (b *QueryBuilder) OrderBy(sorts ...Sort) *QueryBuilder {
+	for _, sort := range sorts {
+		if _, ok := b.column(sort.Column); ok {
+			b.sorts = append(b.sorts, sort)
+		}
+	}
+	return b
+}
+
+func (b *QueryBuilder) Limit(limit int) *QueryBuilder {
+	if limit < 0 {
+		b.fail(fmt.Errorf("%w: negative limit %d", ErrInvalidQuery, limit))
+	}
+	b.limit = limit
+	return b
+}
+
+func (b *QueryBuilder) Offset(offset int) *QueryBuilder {
+	if offset < 0 {
+		b.fail(fmt.Errorf("%w: negative offset %d", ErrInvalidQuery, offset))
+	}
+	b.offset = offset
+	return b
+}
+
+// After continues keyset pagination behind the row whose sort column values
+// are values, in OrderBy order. The last sort column must be unique, e.g.
+// the primary key, for pages not to skip or repeat rows. NULLs in sort
+// columns are not supported.
+func (b *QueryBuilder) After(values ...interface{}) *QueryBuilder {
+	b.after = values
+	return b
+}
+
+// Build returns the query and its arguments, or the first error caused by
+// the input.
+func (b *QueryBuilder) Build() (string, []interface{}, error) {
+	if b.err != nil {
+		return "", nil, b.err
+	}
+	conditions, args := b.conditions, b.args
+	if b.after != nil {
+		keyset, keysetArgs, err := b.keyset()
+		if err != nil {
+			return "", nil, err
+		}
+		conditions = append(conditions[:len(conditions):len(conditions)], keyset)
+		args = append(args[:len(args):len(args)], keysetArgs...)
+	}
+
+	fields := "*"
+	if len(b.fields) > 0 {
+		fields = strings.Join(b.fields, ", ")
+	}
+	var sb strings.Builder
+	sb.WriteString("SELECT " + fields + " FROM " + b.table)
+	writeWhere(&sb, conditions)
+	if len(b.sorts) > 0 {
+		order := make([]string, len(b.sorts))
+		for i, sort := range b.sorts {
+			column, _ := b.column(sort.Column)
+			order[i] = column + sortDirection(sort.Desc)
+		}
+		sb.WriteString(" ORDER BY " + strings.Join(order, ", "))
+	}
+	if b.limit > 0 {
+		sb.WriteString(" LIMIT " + strconv.Itoa(b.limit))
+	}
+	if b.offset > 0 {
+		sb.WriteString(" OFFSET " + strconv.Itoa(b.offset))
+	}
+	return numberPlaceholders(sb.String()), args, nil
+}
+
+// BuildCount returns a query counting every row that matches the filters,
+// ignoring sorting and pagination.
+func (b *QueryBuilder) BuildCount() (string, []interface{}, error) {
+	if b.err != nil {
+		return "", nil, b.err
+	}
+	var sb strings.Builder
+	sb.WriteString("SELECT count(*) FROM " + b.table)
+	writeWhere(&sb, b.conditions)
+	return numberPlaceholders(sb.String()), b.args, nil
+}
+
+func (b *QueryBuilder) fail(err error) {
+	if b.err == nil {
+		b.err = err
+	}
+}
+
+func (b *QueryBuilder) column(name string) (string, bool) {
+	column, ok := b.allowed[name]
+	if !ok {
+		b.fail(fmt.Errorf("%w %q", ErrUnknownColumn, name))
+		return "", false
+	}
+	return quoteIdentifier(column), true
+}
+
+func (b *QueryBuilder) addFilter(column string, filter Filter) error {
+	if op, ok := comparisonOps[filter.Op]; ok {
+		b.conditions = append(b.conditions, column+" "+op+" ?")
+		b.args = append(b.args, filter.Value)
+		return nil
+	}
+	switch filter.Op {
+	case OpIn:
+		b.conditions = append(b.conditions, column+" = ANY(?)")
+		b.args = append(b.args, filter.Value)
+	case OpNotIn:
+		b.conditions = append(b.conditions, "NOT ("+column+" = ANY(?))")
+		b.args = append(b.args, filter.Value)
+	case OpContains:
+		s, ok := filter.Value.(string)
+		if !ok {
+			return fmt.Errorf("%w: %s needs a string, got %T", ErrInvalidQuery, OpContains, filter.Value)
+		}
+		b.conditions = append(b.conditions, column+` ILIKE ? ESCAPE '\'`)
+		b.args = append(b.args, "%"+escapeLike(s)+"%")
+	case OpIsNull:
+		b.conditions = append(b.conditions, column+" IS NULL")
+	case OpNotNull:
+		b.conditions = append(b.conditions, column+" IS NOT NULL")
+	default:
+		return fmt.Errorf("%w %q", ErrUnknownOperator, filter.Op)
+	}
+	return nil
+}
+
+// keyset expands the cursor into (a > ?) OR (a = ? AND b > ?) ..., which,
+// unlike a row comparison, also works when columns sort in mixed directions.
+func (b *QueryBuilder) keyset() (string, []interface{}, error) {
+	if len(b.after) != len(b.sorts) {
+		return "", nil, fmt.Errorf("%w: cursor has %d values for %d sort columns",
+			ErrInvalidQuery, len(b.after), len(b.sorts))
+	}
+	var (
+		terms []string
+		args  []interface{}
+	)
+	for i, sort := range b.sorts {
+		var parts []string
+		for j := 0; j < i; j++ {
+			column, _ := b.column(b.sorts[j].Column)
+			parts = append(parts, column+" = ?")
+			args = append(args, b.after[j])
+		}
+		column, _ := b.column(sort.Column)
+		cmp := " > ?"
+		if sort.Desc {
+			cmp = " < ?"
+		}
+		parts = append(parts, column+cmp)
+		args = append(args, b.after[i])
+		terms = append(terms, "("+strings.Join(parts, " AND ")+")")
+	}
+	return "(" + strings.Join(terms, " OR ") + ")", args, nil
+}
+
+func writeWhere(sb *strings.Builder, conditions []string) {
+	if len(conditions) > 0 {
+		sb.WriteString(" WHERE " + strings.Join(conditions, " AND "))
+	}
+}
+
+func sortDirection(desc bool) string {
+	if desc {
+		return " DESC"
+	}
+	return " ASC"
+}
+
+// numberPlaceholders turns every ? into $1, $2... as pgx expects. Only
+// builder generated SQL and WhereRaw conditions reach it, never values.
+func numberPlaceholders(query string) string {
+	var sb strings.Builder
+	n := 0
+	for _, r := range query {
+		if r == '?' {
+			n++
+			sb.WriteString("$" + strconv.Itoa(n))
+			continue
+		}
+		sb.WriteRune(r)
+	}
+	return sb.String()
+}
+
+func quoteIdentifier(name string) string {
+	if name == "*" {
+		return name
+	}
+	return pgx.Identifier(strings.Split(name, ".")).Sanitize()
+}
+
+var likeEscaper = strings.NewReplacer(`\`, `\\`, `%`, `\%`, `_`, `\_`)
+
+func escapeLike(s string) string {
+	return likeEscaper.Replace(s)
+}
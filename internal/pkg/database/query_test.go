@@ -0,0 +1,220 @@
+package database
+
+import (
+	"errors"
+	"reflect"
+	"testing"
+)
+
+var testColumns = Columns{
+	"id":        "id",
+	"name":      "name",
+	"createdAt": "u.created_at",
+}
+
+func TestQueryBuilderBuild(t *testing.T) {
+	tests := []struct {
+		name     string
+		build    func() *QueryBuilder
+		wantSQL  string
+		wantArgs []interface{}
+	}{
+		{
+			name:    "all columns",
+			build:   func() *QueryBuilder { return NewQuery("users", testColumns) },
+			wantSQL: `SELECT * FROM "users"`,
+		},
+		{
+			name: "filters, sorting and pagination",
+			build: func() *QueryBuilder {
+				return NewQuery("app.users", testColumns).
+					Select("id", "name").
+					Where(Filter{Column: "name", Op: OpEq, Value: "bob"}, Filter{Column: "createdAt", Op: OpGte, Value: "2024-01-01"}).
+					OrderBy(Sort{Column: "createdAt", Desc: true}, Sort{Column: "id"}).
+					Limit(20).
+					Offset(40)
+			},
+			wantSQL: `SELECT "id", "name" FROM "app"."users" WHERE "name" = $1 AND "u"."created_at" >= $2` +
+				` ORDER BY "u"."created_at" DESC, "id" ASC LIMIT 20 OFFSET 40`,
+			wantArgs: []interface{}{"bob", "2024-01-01"},
+		},
+		{
+			name: "set and null operators",
+			build: func() *QueryBuilder {
+				return NewQuery("users", testColumns).Where(
+					Filter{Column: "id", Op: OpIn, Value: []int{1, 2}},
+					Filter{Column: "name", Op: OpNotIn, Value: []string{"x"}},
+					Filter{Column: "createdAt", Op: OpIsNull},
+					Filter{Column: "name", Op: OpNotNull, Value: "ignored"},
+				)
+			},
+			wantSQL: `SELECT * FROM "users" WHERE "id" = ANY($1) AND NOT ("name" = ANY($2))` +
+				` AND "u"."created_at" IS NULL AND "name" IS NOT NULL`,
+			wantArgs: []interface{}{[]int{1, 2}, []string{"x"}},
+		},
+		{
+			name: "contains escapes wildcards",
+			build: func() *QueryBuilder {
+				return NewQuery("users", testColumns).Where(Filter{Column: "name", Op: OpContains, Value: `50%_off\`})
+			},
+			wantSQL:  `SELECT * FROM "users" WHERE "name" ILIKE $1 ESCAPE '\'`,
+			wantArgs: []interface{}{`%50\%\_off\\%`},
+		},
+		{
+			name: "raw conditions",
+			build: func() *QueryBuilder {
+				return NewQuery("users", testColumns).
+					Where(Filter{Column: "name", Op: OpNe, Value: "bob"}).
+					WhereRaw("age > ? AND age < ?", 18, 65)
+			},
+			wantSQL:  `SELECT * FROM "users" WHERE "name" <> $1 AND (age > $2 AND age < $3)`,
+			wantArgs: []interface{}{"bob", 18, 65},
+		},
+		{
+			name: "keyset in mixed directions",
+			build: func() *QueryBuilder {
+				return NewQuery("users", testColumns).
+					Where(Filter{Column: "name", Op: OpEq, Value: "bob"}).
+					OrderBy(Sort{Column: "createdAt", Desc: true}, Sort{Column: "id"}).
+					After("2024-01-01", 7).
+					Limit(10)
+			},
+			wantSQL: `SELECT * FROM "users" WHERE "name" = $1 AND (("u"."created_at" < $2)` +
+				` OR ("u"."created_at" = $3 AND "id" > $4)) ORDER BY "u"."created_at" DESC, "id" ASC LIMIT 10`,
+			wantArgs: []interface{}{"bob", "2024-01-01", "2024-01-01", 7},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			b := tt.build()
+			for i := 0; i < 2; i++ {
+				sql, args, err := b.Build()
+				if err != nil {
+					t.Fatal(err)
+				}
+				if sql != tt.wantSQL {
+					t.Errorf("sql = %s\nwant  %s", sql, tt.wantSQL)
+				}
+				if !reflect.DeepEqual(args, tt.wantArgs) {
+					t.Errorf("args = %#v, want %#v", args, tt.wantArgs)
+				}
+			}
+		})
+	}
+}
+
+func TestQueryBuilderBuildCount(t *testing.T) {
+	sql, args, err := NewQuery("users", testColumns).
+		Where(Filter{Column: "name", Op: OpLike, Value: "b%"}).
+		OrderBy(Sort{Column: "id"}).
+		After(3).
+		Limit(10).
+		BuildCount()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := `SELECT count(*) FROM "users" WHERE "name" LIKE $1`; sql != want {
+		t.Errorf("sql = %s, want %s", sql, want)
+	}
+	if !reflect.DeepEqual(args, []interface{}{"b%"}) {
+		t.Errorf("args = %#v", args)
+	}
+}
+
+func TestQueryBuilderErrors(t *testing.T) {
+	tests := []struct {
+		name  string
+		build func() *QueryBuilder
+		want  error
+	}{
+		{
+			name: "unknown filter column",
+			build: func() *QueryBuilder {
+				return NewQuery("users", testColumns).Where(Filter{Column: "password", Op: OpEq})
+			},
+			want: ErrUnknownColumn,
+		},
+		{
+			name:  "unknown sort column",
+			build: func() *QueryBuilder { return NewQuery("users", testColumns).OrderBy(Sort{Column: "password"}) },
+			want:  ErrUnknownColumn,
+		},
+		{
+			name:  "unknown operator",
+			build: func() *QueryBuilder { return NewQuery("users", testColumns).Where(Filter{Column: "name", Op: "regex"}) },
+			want:  ErrUnknownOperator,
+		},
+		{
+			name: "contains needs a string",
+			build: func() *QueryBuilder {
+				return NewQuery("users", testColumns).Where(Filter{Column: "name", Op: OpContains, Value: 1})
+			},
+			want: ErrInvalidQuery,
+		},
+		{
+			name:  "raw argument count",
+			build: func() *QueryBuilder { return NewQuery("users", testColumns).WhereRaw("a = ? AND b = ?", 1) },
+			want:  ErrInvalidQuery,
+		},
+		{
+			name:  "negative limit",
+			build: func() *QueryBuilder { return NewQuery("users", testColumns).Limit(-1) },
+			want:  ErrInvalidQuery,
+		},
+		{
+			name:  "negative offset",
+			build: func() *QueryBuilder { return NewQuery("users", testColumns).Offset(-1) },
+			want:  ErrInvalidQuery,
+		},
+		{
+			name: "cursor length",
+			build: func() *QueryBuilder {
+				return NewQuery("users", testColumns).OrderBy(Sort{Column: "createdAt"}, Sort{Column: "id"}).After(7)
+			},
+			want: ErrInvalidQuery,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, _, err := tt.build().Build(); !errors.Is(err, tt.want) {
+				t.Errorf("Build() error = %v, want %v", err, tt.want)
+			}
+		})
+	}
+}
+
+func TestNumberPlaceholders(t *testing.T) {
+	tests := map[string]string{
+		"":                      "",
+		"SELECT 1":              "SELECT 1",
+		"a = ?":                 "a = $1",
+		"a = ? AND b IN (?, ?)": "a = $1 AND b IN ($2, $3)",
+	}
+	for query, want := range tests {
+		if got := numberPlaceholders(query); got != want {
+			t.Errorf("numberPlaceholders(%q) = %q, want %q", query, got, want)
+		}
+	}
+}
+
+func TestParseSort(t *testing.T) {
+	got := ParseSort("name, -createdAt,,")
+	want := []Sort{{Column: "name"}, {Column: "createdAt", Desc: true}}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("ParseSort() = %+v, want %+v", got, want)
+	}
+	if got := ParseSort(""); got != nil {
+		t.Errorf("ParseSort(\"\") = %+v, want nil", got)
+	}
+}
+
+func TestParseOp(t *testing.T) {
+	for _, op := range []Op{OpEq, OpNe, OpLt, OpLte, OpGt, OpGte, OpIn, OpNotIn, OpLike, OpILike, OpContains, OpIsNull, OpNotNull} {
+		if got, err := ParseOp(string(op)); err != nil || got != op {
+			t.Errorf("ParseOp(%q) = %q, %v", op, got, err)
+		}
+	}
+	if _, err := ParseOp("regex"); !errors.Is(err, ErrUnknownOperator) {
+		t.Errorf("ParseOp(\"regex\") error = %v, want %v", err, ErrUnknownOperator)
+	}
+}
@@ -0,0 +1,260 @@
+package database
+
+import (
+	"context"
+	"fmt"
+	"github.com/jackc/pgx/v4/pgxpool"
+	"github.com/jmoiron/sqlx"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	RoundRobinBalancer       = "round_robin"
+	LeastConnectionsBalancer = "least_connections"
+	WeightedBalancer         = "weighted"
+)
+
+// replicationLagQuery reports how far a standby is behind master, given
+// master's current WAL position as $1. A standby that has replayed up to it is
+// not lagging even if the last replayed transaction is old, which happens
+// when master is idle. Comparing with its own receive position instead would
+// also report 0 for a standby whose WAL receiver is disconnected. Otherwise
+// the lag is the age of the last replayed transaction, or of the server when
+// it has replayed none yet.
+const replicationLagQuery = `SELECT CASE
+	WHEN NOT pg_is_in_recovery() THEN 0
+	WHEN pg_last_wal_replay_lsn() >= $1::pg_lsn THEN 0
+	ELSE EXTRACT(EPOCH FROM now() - COALESCE(pg_last_xact_replay_timestamp(), pg_postmaster_start_time()))
+END::float8`
+
+type replica struct {
+	name    string
+	db      *sqlx.DB
+	native  *pgxpool.Pool
+	weight  int
+	healthy atomic.Bool
+	lag     atomic.Int64
+	lagging atomic.Bool
+	breaker *breaker
+
+	// currentWeight is only touched by weightedBalancer under its mutex.
+	currentWeight int
+}
+
+func newReplica(name string, db *sqlx.DB, native *pgxpool.Pool, weight int, breaker *breaker) *replica {
+	if weight <= 0 {
+		weight = 1
+	}
+	r := &replica{
+		name:    name,
+		db:      db,
+		native:  native,
+		weight:  weight,
+		breaker: breaker,
+	}
+	r.healthy.Store(true)
+	return r
+}
+
+func (r *replica) close() {
+	_ = r.db.Close()
+	if r.native != nil {
+		r.native.Close()
+	}
+}
+
+func (r *replica) inUse() int {
+	return poolInUse(r.db, r.native)
+}
+
+// poolInUse counts the connections checked out of an instance, from the
+// database/sql pool and the native pool alike.
+func poolInUse(db *sqlx.DB, native *pgxpool.Pool) int {
+	inUse := db.Stats().InUse
+	if native != nil {
+		inUse += int(native.Stat().AcquiredConns())
+	}
+	return inUse
+}
+
+func (r *replica) check(ctx context.Context, timeout time.Duration) error {
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+	return r.db.PingContext(ctx)
+}
+
+func (r *replica) measureLag(ctx context.Context, timeout time.Duration, masterLSN string) (time.Duration, error) {
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	var seconds float64
+	if err := r.db.GetContext(ctx, &seconds, replicationLagQuery, masterLSN); err != nil {
+		return 0, err
+	}
+	lag := time.Duration(seconds * float64(time.Second))
+	r.lag.Store(int64(lag))
+	return lag, nil
+}
+
+func (r *replica) usable(maxLag time.Duration) bool {
+	if !r.healthy.Load() {
+		return false
+	}
+	return maxLag <= 0 || !r.lagging.Load()
+}
+
+type balancer interface {
+	pick(replicas []*replica) *replica
+}
+
+func newBalancer(name string) (balancer, error) {
+	switch name {
+	case "", RoundRobinBalancer:
+		return &roundRobin{}, nil
+	case LeastConnectionsBalancer:
+		return &leastConnections{}, nil
+	case WeightedBalancer:
+		return &weighted{}, nil
+	default:
+		return nil, fmt.Errorf("unknown load balancer %q", name)
+	}
+}
+
+type roundRobin struct {
+	counter atomic.Uint64
+}
+
+func (b *roundRobin) pick(replicas []*replica) *replica {
+	n := b.counter.Add(1) - 1
+	return replicas[n%uint64(len(replicas))]
+}
+
+type leastConnections struct{}
+
+func (b *leastConnections) pick(replicas []*replica) *replica {
+	best := replicas[0]
+	bestInUse := best.inUse()
+	for _, r := range replicas[1:] {
+		if inUse := r.inUse(); inUse < bestInUse {
+			best, bestInUse = r, inUse
+		}
+	}
+	return best
+}
+
+// weighted implements smooth weighted round-robin, so a replica with weight 3
+// next to one with weight 1 is picked a-a-b-a rather than a-a-a-b.
+type weighted struct {
+	mu sync.Mutex
+}
+
+func (b *weighted) pick(replicas []*replica) *replica {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	var best *replica
+	total := 0
+	for _, r := range replicas {
+		r.currentWeight += r.weight
+		total += r.weight
+		if best == nil || r.currentWeight > best.currentWeight {
+			best = r
+		}
+	}
+	best.currentWeight -= total
+	return best
+}
+
+func (p *Postgres) pickReplica() *replica {
+	candidates := make([]*replica, 0, len(p.replicas))
+	for _, r := range p.replicas {
+		if r.usable(p.maxReplicationLag) && r.breaker.ready() {
+			candidates = append(candidates, r)
+		}
+	}
+	if len(candidates) == 0 {
+		return nil
+	}
+	// ready does not reserve a half-open probe, so another request may
+	// have taken the last one meanwhile; master serves this read then.
+	r := p.balancer.pick(candidates)
+	if !r.breaker.allow() {
+		return nil
+	}
+	return r
+}
+
+func (p *Postgres) runHealthCheck(interval time.Duration) {
+	defer p.wg.Done()
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-p.done:
+			return
+		case <-ticker.C:
+			p.checkReplicas()
+		}
+	}
+}
+
+func (p *Postgres) checkReplicas() {
+	// Lag is measured against master's WAL position, read once per round
+	// and before the replicas so they can only look further behind. Without
+	// it lagging keeps its last value.
+	var masterLSN string
+	checkLag := p.maxReplicationLag > 0 && len(p.replicas) > 0
+	if checkLag {
+		var err error
+		if masterLSN, err = p.currentWALLSN(context.Background()); err != nil {
+			p.logger.Warnf("postgres: read master WAL position for replication lag failed: %s", err)
+			checkLag = false
+		}
+	}
+	for _, r := range p.replicas {
+		err := r.check(context.Background(), p.healthCheckTimeout)
+		healthy := err == nil
+		if r.healthy.Swap(healthy) != healthy {
+			if healthy {
+				p.logger.Infof("postgres replica %s is healthy again", r.name)
+			} else {
+				p.logger.Warnf("postgres replica %s failed health check: %s", r.name, err)
+			}
+		}
+		if healthy && checkLag {
+			p.checkLag(r, masterLSN)
+		}
+	}
+}
+
+func (p *Postgres) currentWALLSN(ctx context.Context) (string, error) {
+	ctx, cancel := context.WithTimeout(ctx, p.healthCheckTimeout)
+	defer cancel()
+
+	var lsn string
+	if err := p.writeDB.GetContext(ctx, &lsn, "SELECT pg_current_wal_lsn()::text"); err != nil {
+		return "", err
+	}
+	return lsn, nil
+}
+
+func (p *Postgres) checkLag(r *replica, masterLSN string) {
+	lag, err := r.measureLag(context.Background(), p.healthCheckTimeout, masterLSN)
+	if err != nil {
+		p.logger.Warnf("postgres replica %s: measure replication lag failed: %s", r.name, err)
+		return
+	}
+	lagging := lag > p.maxReplicationLag
+	if r.lagging.Swap(lagging) == lagging {
+		return
+	}
+	if lagging {
+		p.logger.Warnf("postgres replica %s is %s behind master, exceeding %s", r.name, lag, p.maxReplicationLag)
+	} else {
+		p.logger.Infof("postgres replica %s caught up with master (lag %s)", r.name, lag)
+	}
+}
@@ -0,0 +1,93 @@
+package database
+
+import (
+	"context"
+	"database/sql"
+	"github.com/jmoiron/sqlx"
+	"strings"
+	"testing"
+)
+
+func newTestReplicas(t *testing.T, weights ...int) []*replica {
+	t.Helper()
+	replicas := make([]*replica, len(weights))
+	for i, weight := range weights {
+		db := sqlx.NewDb(sql.OpenDB(&fakeConnector{}), "pgx")
+		t.Cleanup(func() { _ = db.Close() })
+		replicas[i] = newReplica(string(rune('a'+i)), db, nil, weight, nil)
+	}
+	return replicas
+}
+
+func pickSequence(b balancer, replicas []*replica, n int) string {
+	var sb strings.Builder
+	for i := 0; i < n; i++ {
+		sb.WriteString(b.pick(replicas).name)
+	}
+	return sb.String()
+}
+
+func TestNewBalancer(t *testing.T) {
+	for _, name := range []string{"", RoundRobinBalancer, LeastConnectionsBalancer, WeightedBalancer} {
+		if _, err := newBalancer(name); err != nil {
+			t.Errorf("newBalancer(%q): %s", name, err)
+		}
+	}
+	if _, err := newBalancer("random"); err == nil {
+		t.Error("newBalancer(\"random\") succeeded, want an error")
+	}
+}
+
+func TestRoundRobin(t *testing.T) {
+	replicas := newTestReplicas(t, 1, 1, 1)
+	if got := pickSequence(&roundRobin{}, replicas, 7); got != "abcabca" {
+		t.Errorf("picks = %s, want abcabca", got)
+	}
+}
+
+func TestWeighted(t *testing.T) {
+	tests := []struct {
+		weights []int
+		want    string
+	}{
+		{weights: []int{3, 1}, want: "aabaaaba"},
+		{weights: []int{1, 1}, want: "abab"},
+		{weights: []int{5, 1, 1}, want: "aabacaa"},
+		// Weights below 1 count as 1.
+		{weights: []int{0, -2}, want: "abab"},
+	}
+	for _, tt := range tests {
+		replicas := newTestReplicas(t, tt.weights...)
+		if got := pickSequence(&weighted{}, replicas, len(tt.want)); got != tt.want {
+			t.Errorf("weights %v: picks = %s, want %s", tt.weights, got, tt.want)
+		}
+	}
+}
+
+func TestLeastConnections(t *testing.T) {
+	replicas := newTestReplicas(t, 1, 1, 1)
+	ctx := context.Background()
+	checkout := func(r *replica) {
+		conn, err := r.db.Conn(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { _ = conn.Close() })
+	}
+
+	b := &leastConnections{}
+	if got := b.pick(replicas).name; got != "a" {
+		t.Errorf("idle replicas: picked %s, want the first one", got)
+	}
+	checkout(replicas[0])
+	checkout(replicas[0])
+	checkout(replicas[2])
+	if got := b.pick(replicas).name; got != "b" {
+		t.Errorf("picked %s, want b with no connection in use", got)
+	}
+	checkout(replicas[1])
+	checkout(replicas[1])
+	if got := b.pick(replicas).name; got != "c" {
+		t.Errorf("picked %s, want c with one connection in use", got)
+	}
+}
@@ -0,0 +1,418 @@
+package database
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"github.com/jackc/pgx/v4"
+	"github.com/jmoiron/sqlx"
+	"github.com/jmoiron/sqlx/reflectx"
+	"reflect"
+	"strconv"
+	"strings"
+)
+
+const defaultPageLimit = 50
+
+var repositoryMapper = reflectx.NewMapperFunc("db", sqlx.NameMapper)
+
+// RepositoryOptions configures a Repository. PrimaryKey defaults to "id".
+// With SoftDelete set, Delete stamps that nullable timestamp column instead
+// of removing the row, and reads skip rows where it is set.
+type RepositoryOptions struct {
+	PrimaryKey string
+	SoftDelete string
+}
+
+// Repository implements the usual CRUD statements for the struct T stored in
+// one table. Columns come from the db tags of T, the same way sqlx maps them.
+// Two tag options tune writes:
+//
+//	ID        int64     `db:"id,default"`         // left to the database while zero
+//	CreatedAt time.Time `db:"created_at,readonly"` // never written
+//
+// Reads go through GetReadConnection and writes through GetWriteConnection,
+// so they join the request transaction when ctx carries one.
+type Repository[T any] struct {
+	postgres *Postgres
+	table    string
+	columns  []repositoryColumn
+	pk       repositoryColumn
+	opts     RepositoryOptions
+	unscoped bool
+}
+
+type repositoryColumn struct {
+	name      string
+	quoted    string
+	index     []int
+	defaulted bool
+	readonly  bool
+}
+
+func NewRepository[T any](postgres *Postgres, table string, opts RepositoryOptions) (*Repository[T], error) {
+	if opts.PrimaryKey == "" {
+		opts.PrimaryKey = "id"
+	}
+	t := reflect.TypeOf((*T)(nil)).Elem()
+	if t.Kind() != reflect.Struct {
+		return nil, fmt.Errorf("repository: %s is not a struct", t)
+	}
+
+	r := &Repository[T]{
+		postgres: postgres,
+		table:    quoteIdentifier(table),
+		opts:     opts,
+	}
+	structMap := repositoryMapper.TypeMap(t)
+	foundPK := false
+	for _, fi := range structMap.Index {
+		// Nested paths belong to struct valued columns such as time.Time.
+		if fi.Embedded || strings.Contains(fi.Path, ".") || structMap.Paths[fi.Path] != fi {
+			continue
+		}
+		_, defaulted := fi.Options["default"]
+		_, readonly := fi.Options["readonly"]
+		column := repositoryColumn{
+			name:      fi.Path,
+			quoted:    pgx.Identifier{fi.Path}.Sanitize(),
+			index:     fi.Index,
+			defaulted: defaulted,
+			readonly:  readonly,
+		}
+		if column.name == opts.PrimaryKey {
+			column.defaulted = true
+			r.pk, foundPK = column, true
+		}
+		r.columns = append(r.columns, column)
+	}
+	if !foundPK {
+		return nil, fmt.Errorf("repository: %s has no column %q for the primary key", t, opts.PrimaryKey)
+	}
+	return r, nil
+}
+
+// Unscoped returns a copy of the repository that also sees soft-deleted rows
+// and whose Delete removes rows for good.
+func (r *Repository[T]) Unscoped() *Repository[T] {
+	clone := *r
+	clone.unscoped = true
+	return &clone
+}
+
+func (r *Repository[T]) FindByID(ctx context.Context, id interface{}) (*T, error) {
+	conn, err := r.postgres.GetReadConnection(ctx)
+	if err != nil {
+		return nil, err
+	}
+	var entity T
+	query := fmt.Sprintf("SELECT %s FROM %s WHERE %s = $1%s",
+		r.selectList(), r.table, r.pk.quoted, r.scope(" AND "))
+	if err := conn.GetContext(ctx, &entity, query, id); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, ErrNotFound
+		}
+		return nil, fmt.Errorf("repository: find %s failed: %w", r.table, err)
+	}
+	return &entity, nil
+}
+
+// FindWhere returns the rows matching where, a SQL condition using $1, $2...
+// for args. An empty where matches every row.
+func (r *Repository[T]) FindWhere(ctx context.Context, where string, args ...interface{}) ([]T, error) {
+	conn, err := r.postgres.GetReadConnection(ctx)
+	if err != nil {
+		return nil, err
+	}
+	var entities []T
+	query := fmt.Sprintf("SELECT %s FROM %s%s", r.selectList(), r.table, r.where(where))
+	if err := conn.SelectContext(ctx, &entities, query, args...); err != nil {
+		return nil, fmt.Errorf("repository: find %s failed: %w", r.table, err)
+	}
+	return entities, nil
+}
+
+// Insert writes entity and scans the stored row back into it, which fills in
+// the primary key and other database defaults.
+func (r *Repository[T]) Insert(ctx context.Context, entity *T) error {
+	values, args := r.insertValues(entity)
+	query := fmt.Sprintf("INSERT INTO %s %s RETURNING %s", r.table, values, r.selectList())
+	if err := r.writeReturning(ctx, entity, query, args); err != nil {
+		return fmt.Errorf("repository: insert into %s failed: %w", r.table, err)
+	}
+	return nil
+}
+
+// Update writes every column of entity except the primary key and readonly
+// columns. It returns ErrNotFound when no live row has entity's primary key.
+func (r *Repository[T]) Update(ctx context.Context, entity *T) error {
+	value := reflect.ValueOf(entity).Elem()
+	var (
+		sets []string
+		args []interface{}
+	)
+	for _, column := range r.columns {
+		if column.readonly || column.name == r.pk.name {
+			continue
+		}
+		args = append(args, reflectx.FieldByIndexesReadOnly(value, column.index).Interface())
+		sets = append(sets, column.quoted+" = $"+strconv.Itoa(len(args)))
+	}
+	if len(sets) == 0 {
+		return fmt.Errorf("repository: %s has no updatable columns", r.table)
+	}
+	args = append(args, reflectx.FieldByIndexesReadOnly(value, r.pk.index).Interface())
+	query := fmt.Sprintf("UPDATE %s SET %s WHERE %s = $%d%s RETURNING %s",
+		r.table, strings.Join(sets, ", "), r.pk.quoted, len(args), r.scope(" AND "), r.selectList())
+
+	err := r.writeReturning(ctx, entity, query, args)
+	if errors.Is(err, sql.ErrNoRows) {
+		return ErrNotFound
+	}
+	if err != nil {
+		return fmt.Errorf("repository: update %s failed: %w", r.table, err)
+	}
+	return nil
+}
+
+// Upsert inserts entity or, when a row with the same conflict columns exists,
+// updates it. conflict defaults to the primary key.
+func (r *Repository[T]) Upsert(ctx context.Context, entity *T, conflict ...string) error {
+	query, args := r.upsertQuery(entity, conflict)
+	err := r.writeReturning(ctx, entity, query, args)
+	if errors.Is(err, sql.ErrNoRows) {
+		// DO NOTHING returns no row for a conflict; the row is already there.
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("repository: upsert into %s failed: %w", r.table, err)
+	}
+	return nil
+}
+
+// upsertQuery returns the statement of Upsert and its arguments. Without
+// columns left to update the conflict does nothing.
+func (r *Repository[T]) upsertQuery(entity *T, conflict []string) (string, []interface{}) {
+	if len(conflict) == 0 {
+		conflict = []string{r.pk.name}
+	}
+	isConflict := make(map[string]bool, len(conflict))
+	quotedConflict := make([]string, len(conflict))
+	for i, name := range conflict {
+		isConflict[name] = true
+		quotedConflict[i] = pgx.Identifier{name}.Sanitize()
+	}
+
+	values, args := r.insertValues(entity)
+	var sets []string
+	for _, column := range r.columns {
+		if column.readonly || isConflict[column.name] || column.name == r.pk.name {
+			continue
+		}
+		sets = append(sets, column.quoted+" = EXCLUDED."+column.quoted)
+	}
+	action := "DO NOTHING"
+	if len(sets) > 0 {
+		action = "DO UPDATE SET " + strings.Join(sets, ", ")
+	}
+	query := fmt.Sprintf("INSERT INTO %s %s ON CONFLICT (%s) %s RETURNING %s",
+		r.table, values, strings.Join(quotedConflict, ", "), action, r.selectList())
+	return query, args
+}
+
+// Delete removes the row with primary key id, or soft-deletes it when the
+// repository has a SoftDelete column. It returns ErrNotFound when there is no
+// such live row.
+func (r *Repository[T]) Delete(ctx context.Context, id interface{}) error {
+	conn, err := r.postgres.GetWriteConnection(ctx)
+	if err != nil {
+		return err
+	}
+	query := fmt.Sprintf("DELETE FROM %s WHERE %s = $1", r.table, r.pk.quoted)
+	if r.opts.SoftDelete != "" && !r.unscoped {
+		query = fmt.Sprintf("UPDATE %s SET %s = now() WHERE %s = $1%s",
+			r.table, pgx.Identifier{r.opts.SoftDelete}.Sanitize(), r.pk.quoted, r.scope(" AND "))
+	}
+	result, err := conn.ExecContext(ctx, query, id)
+	if err != nil {
+		return fmt.Errorf("repository: delete from %s failed: %w", r.table, err)
+	}
+	if n, err := result.RowsAffected(); err == nil && n == 0 {
+		return ErrNotFound
+	}
+	return nil
+}
+
+// PageRequest asks for one page of rows ordered by OrderBy, the primary key by
+// default, with the primary key breaking ties. After is the Next cursor of
+// the previous page, nil for the first one.
+type PageRequest struct {
+	Where   string
+	Args    []interface{}
+	OrderBy string
+	Desc    bool
+	Limit   int
+	After   *Cursor
+}
+
+// Cursor marks the last row of a page: its OrderBy value and primary key.
+type Cursor struct {
+	Value interface{}
+	ID    interface{}
+}
+
+// Page holds one page of rows. Next is nil on the last page.
+type Page[T any] struct {
+	Items []T
+	Next  *Cursor
+}
+
+// Page reads one page using keyset pagination, which stays fast on deep
+// pages and does not skip or repeat rows when rows are inserted meanwhile.
+func (r *Repository[T]) Page(ctx context.Context, req PageRequest) (*Page[T], error) {
+	query, args, orderBy, err := r.pageQuery(req)
+	if err != nil {
+		return nil, err
+	}
+	conn, err := r.postgres.GetReadConnection(ctx)
+	if err != nil {
+		return nil, err
+	}
+	var items []T
+	if err := conn.SelectContext(ctx, &items, query, args...); err != nil {
+		return nil, fmt.Errorf("repository: page %s failed: %w", r.table, err)
+	}
+
+	limit := req.limit()
+	page := &Page[T]{Items: items}
+	if len(items) > limit {
+		page.Items = items[:limit]
+		last := reflect.ValueOf(&page.Items[limit-1]).Elem()
+		page.Next = &Cursor{
+			Value: reflectx.FieldByIndexesReadOnly(last, orderBy.index).Interface(),
+			ID:    reflectx.FieldByIndexesReadOnly(last, r.pk.index).Interface(),
+		}
+	}
+	return page, nil
+}
+
+func (req PageRequest) limit() int {
+	if req.Limit <= 0 {
+		return defaultPageLimit
+	}
+	return req.Limit
+}
+
+// pageQuery returns the statement of Page, which reads one row past the
+// limit to tell whether another page follows, its arguments and the column
+// the rows are ordered by.
+func (r *Repository[T]) pageQuery(req PageRequest) (string, []interface{}, repositoryColumn, error) {
+	orderBy := r.pk
+	if req.OrderBy != "" && req.OrderBy != r.pk.name {
+		column, ok := r.column(req.OrderBy)
+		if !ok {
+			return "", nil, repositoryColumn{}, fmt.Errorf("repository: %s has no column %q", r.table, req.OrderBy)
+		}
+		orderBy = column
+	}
+
+	direction, cmp := "ASC", ">"
+	if req.Desc {
+		direction, cmp = "DESC", "<"
+	}
+	args := append([]interface{}(nil), req.Args...)
+	conditions := []string{}
+	if req.Where != "" {
+		conditions = append(conditions, "("+req.Where+")")
+	}
+	if req.After != nil {
+		if orderBy.name == r.pk.name {
+			args = append(args, req.After.ID)
+			conditions = append(conditions, fmt.Sprintf("%s %s $%d", r.pk.quoted, cmp, len(args)))
+		} else {
+			args = append(args, req.After.Value, req.After.ID)
+			conditions = append(conditions, fmt.Sprintf("(%s, %s) %s ($%d, $%d)",
+				orderBy.quoted, r.pk.quoted, cmp, len(args)-1, len(args)))
+		}
+	}
+	order := r.pk.quoted + " " + direction
+	if orderBy.name != r.pk.name {
+		order = orderBy.quoted + " " + direction + ", " + order
+	}
+
+	query := fmt.Sprintf("SELECT %s FROM %s%s ORDER BY %s LIMIT %d",
+		r.selectList(), r.table, r.where(strings.Join(conditions, " AND ")), order, req.limit()+1)
+	return query, args, orderBy, nil
+}
+
+func (r *Repository[T]) column(name string) (repositoryColumn, bool) {
+	for _, column := range r.columns {
+		if column.name == name {
+			return column, true
+		}
+	}
+	return repositoryColumn{}, false
+}
+
+func (r *Repository[T]) selectList() string {
+	quoted := make([]string, len(r.columns))
+	for i, column := range r.columns {
+		quoted[i] = column.quoted
+	}
+	return strings.Join(quoted, ", ")
+}
+
+// scope returns the soft-delete condition prefixed with join, or "" when the
+// repository sees every row.
+func (r *Repository[T]) scope(join string) string {
+	if r.opts.SoftDelete == "" || r.unscoped {
+		return ""
+	}
+	return join + pgx.Identifier{r.opts.SoftDelete}.Sanitize() + " IS NULL"
+}
+
+func (r *Repository[T]) where(condition string) string {
+	switch {
+	case condition == "":
+		return r.scope(" WHERE ")
+	case r.scope("") == "":
+		return " WHERE " + condition
+	default:
+		return " WHERE (" + condition + ")" + r.scope(" AND ")
+	}
+}
+
+// insertValues returns the column list and VALUES clause of an INSERT of
+// entity together with its arguments.
+func (r *Repository[T]) insertValues(entity *T) (string, []interface{}) {
+	var (
+		columns, placeholders []string
+		args                  []interface{}
+	)
+	value := reflect.ValueOf(entity).Elem()
+	for _, column := range r.columns {
+		if column.readonly {
+			continue
+		}
+		field := reflectx.FieldByIndexesReadOnly(value, column.index)
+		if column.defaulted && field.IsZero() {
+			continue
+		}
+		args = append(args, field.Interface())
+		columns = append(columns, column.quoted)
+		placeholders = append(placeholders, "$"+strconv.Itoa(len(args)))
+	}
+	if len(columns) == 0 {
+		return "DEFAULT VALUES", nil
+	}
+	return fmt.Sprintf("(%s) VALUES (%s)", strings.Join(columns, ", "), strings.Join(placeholders, ", ")), args
+}
+
+func (r *Repository[T]) writeReturning(ctx context.Context, entity *T, query string, args []interface{}) error {
+	conn, err := r.postgres.GetWriteConnection(ctx)
+	if err != nil {
+		return err
+	}
+	return TranslateError(conn.QueryRowxContext(ctx, query, args...).StructScan(entity))
+}
@@ -0,0 +1,229 @@
+package database
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+type testAccount struct {
+	ID        int64     `db:"id"`
+	Email     string    `db:"email"`
+	Name      string    `db:"name"`
+	Plan      string    `db:"plan,default"`
+	CreatedAt time.Time `db:"created_at,readonly"`
+}
+
+type testSequence struct {
+	ID        int64     `db:"id"`
+	CreatedAt time.Time `db:"created_at,readonly"`
+}
+
+type testTag struct {
+	ID   int64  `db:"id"`
+	Name string `db:"name"`
+}
+
+const testAccountColumns = `"id", "email", "name", "plan", "created_at"`
+
+func newTestRepository[T any](t *testing.T, opts RepositoryOptions) *Repository[T] {
+	t.Helper()
+	r, err := NewRepository[T](nil, "accounts", opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return r
+}
+
+func TestRepositoryInsertValues(t *testing.T) {
+	accounts := newTestRepository[testAccount](t, RepositoryOptions{})
+	tests := []struct {
+		name       string
+		values     func() (string, []interface{})
+		wantValues string
+		wantArgs   []interface{}
+	}{
+		{
+			name: "zero defaults left to the database",
+			values: func() (string, []interface{}) {
+				return accounts.insertValues(&testAccount{Email: "a@example.com", Name: "a", CreatedAt: time.Now()})
+			},
+			wantValues: `("email", "name") VALUES ($1, $2)`,
+			wantArgs:   []interface{}{"a@example.com", "a"},
+		},
+		{
+			name: "defaults with a value written",
+			values: func() (string, []interface{}) {
+				return accounts.insertValues(&testAccount{ID: 7, Email: "a@example.com", Name: "a", Plan: "pro"})
+			},
+			wantValues: `("id", "email", "name", "plan") VALUES ($1, $2, $3, $4)`,
+			wantArgs:   []interface{}{int64(7), "a@example.com", "a", "pro"},
+		},
+		{
+			name: "nothing to write",
+			values: func() (string, []interface{}) {
+				return newTestRepository[testSequence](t, RepositoryOptions{}).insertValues(&testSequence{CreatedAt: time.Now()})
+			},
+			wantValues: "DEFAULT VALUES",
+		},
+	}
+	for _, tt := range tests {
+		values, args := tt.values()
+		if values != tt.wantValues {
+			t.Errorf("%s: values = %s\nwant %s", tt.name, values, tt.wantValues)
+		}
+		if !reflect.DeepEqual(args, tt.wantArgs) {
+			t.Errorf("%s: args = %v, want %v", tt.name, args, tt.wantArgs)
+		}
+	}
+}
+
+func TestRepositoryUpsertQuery(t *testing.T) {
+	account := &testAccount{Email: "a@example.com", Name: "a"}
+	tests := []struct {
+		name     string
+		query    func() (string, []interface{})
+		wantSQL  string
+		wantArgs []interface{}
+	}{
+		{
+			name: "conflict on the primary key",
+			query: func() (string, []interface{}) {
+				return newTestRepository[testAccount](t, RepositoryOptions{}).upsertQuery(account, nil)
+			},
+			wantSQL: `INSERT INTO "accounts" ("email", "name") VALUES ($1, $2) ON CONFLICT ("id")` +
+				` DO UPDATE SET "email" = EXCLUDED."email", "name" = EXCLUDED."name", "plan" = EXCLUDED."plan"` +
+				` RETURNING ` + testAccountColumns,
+			wantArgs: []interface{}{"a@example.com", "a"},
+		},
+		{
+			name: "conflict on other columns",
+			query: func() (string, []interface{}) {
+				return newTestRepository[testAccount](t, RepositoryOptions{}).upsertQuery(account, []string{"email"})
+			},
+			wantSQL: `INSERT INTO "accounts" ("email", "name") VALUES ($1, $2) ON CONFLICT ("email")` +
+				` DO UPDATE SET "name" = EXCLUDED."name", "plan" = EXCLUDED."plan"` +
+				` RETURNING ` + testAccountColumns,
+			wantArgs: []interface{}{"a@example.com", "a"},
+		},
+		{
+			name: "nothing left to update",
+			query: func() (string, []interface{}) {
+				return newTestRepository[testTag](t, RepositoryOptions{}).upsertQuery(&testTag{Name: "go"}, []string{"name"})
+			},
+			wantSQL:  `INSERT INTO "accounts" ("name") VALUES ($1) ON CONFLICT ("name") DO NOTHING RETURNING "id", "name"`,
+			wantArgs: []interface{}{"go"},
+		},
+	}
+	for _, tt := range tests {
+		query, args := tt.query()
+		if query != tt.wantSQL {
+			t.Errorf("%s: sql = %s\nwant %s", tt.name, query, tt.wantSQL)
+		}
+		if !reflect.DeepEqual(args, tt.wantArgs) {
+			t.Errorf("%s: args = %v, want %v", tt.name, args, tt.wantArgs)
+		}
+	}
+}
+
+func TestRepositoryPageQuery(t *testing.T) {
+	tests := []struct {
+		name        string
+		opts        RepositoryOptions
+		req         PageRequest
+		wantSQL     string
+		wantArgs    []interface{}
+		wantOrderBy string
+		wantErr     string
+	}{
+		{
+			name:        "first page",
+			wantSQL:     `SELECT ` + testAccountColumns + ` FROM "accounts" ORDER BY "id" ASC LIMIT 51`,
+			wantOrderBy: "id",
+		},
+		{
+			name: "after a primary key, descending",
+			req:  PageRequest{Where: "plan = $1", Args: []interface{}{"pro"}, Desc: true, Limit: 10, After: &Cursor{ID: 7}},
+			wantSQL: `SELECT ` + testAccountColumns + ` FROM "accounts"` +
+				` WHERE (plan = $1) AND "id" < $2 ORDER BY "id" DESC LIMIT 11`,
+			wantArgs:    []interface{}{"pro", 7},
+			wantOrderBy: "id",
+		},
+		{
+			name: "after a value of another column",
+			req:  PageRequest{OrderBy: "name", After: &Cursor{Value: "bob", ID: 7}},
+			wantSQL: `SELECT ` + testAccountColumns + ` FROM "accounts"` +
+				` WHERE ("name", "id") > ($1, $2) ORDER BY "name" ASC, "id" ASC LIMIT 51`,
+			wantArgs:    []interface{}{"bob", 7},
+			wantOrderBy: "name",
+		},
+		{
+			name: "soft delete",
+			opts: RepositoryOptions{SoftDelete: "deleted_at"},
+			req:  PageRequest{Where: "plan = $1", Args: []interface{}{"pro"}, After: &Cursor{ID: 7}},
+			wantSQL: `SELECT ` + testAccountColumns + ` FROM "accounts"` +
+				` WHERE ((plan = $1) AND "id" > $2) AND "deleted_at" IS NULL ORDER BY "id" ASC LIMIT 51`,
+			wantArgs:    []interface{}{"pro", 7},
+			wantOrderBy: "id",
+		},
+		{
+			name:    "unknown column",
+			req:     PageRequest{OrderBy: "missing"},
+			wantErr: `has no column "missing"`,
+		},
+	}
+	for _, tt := range tests {
+		r := newTestRepository[testAccount](t, tt.opts)
+		query, args, orderBy, err := r.pageQuery(tt.req)
+		if tt.wantErr != "" {
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Errorf("%s: error = %v, want it to contain %q", tt.name, err, tt.wantErr)
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatalf("%s: %s", tt.name, err)
+		}
+		if query != tt.wantSQL {
+			t.Errorf("%s: sql = %s\nwant %s", tt.name, query, tt.wantSQL)
+		}
+		if !reflect.DeepEqual(args, tt.wantArgs) {
+			t.Errorf("%s: args = %v, want %v", tt.name, args, tt.wantArgs)
+		}
+		if orderBy.name != tt.wantOrderBy {
+			t.Errorf("%s: ordered by %s, want %s", tt.name, orderBy.name, tt.wantOrderBy)
+		}
+	}
+}
+
+func TestRepositorySoftDeleteScope(t *testing.T) {
+	tests := []struct {
+		name       string
+		softDelete string
+		unscoped   bool
+		condition  string
+		wantScope  string
+		wantWhere  string
+	}{
+		{name: "no soft delete", condition: "plan = $1", wantWhere: " WHERE plan = $1"},
+		{name: "no soft delete, no condition"},
+		{name: "scoped", softDelete: "deleted_at", condition: "plan = $1",
+			wantScope: ` AND "deleted_at" IS NULL`, wantWhere: ` WHERE (plan = $1) AND "deleted_at" IS NULL`},
+		{name: "scoped, no condition", softDelete: "deleted_at",
+			wantScope: ` AND "deleted_at" IS NULL`, wantWhere: ` WHERE "deleted_at" IS NULL`},
+		{name: "unscoped", softDelete: "deleted_at", unscoped: true, condition: "plan = $1", wantWhere: " WHERE plan = $1"},
+	}
+	for _, tt := range tests {
+		r := newTestRepository[testAccount](t, RepositoryOptions{SoftDelete: tt.softDelete})
+		if tt.unscoped {
+			r = r.Unscoped()
+		}
+		if got := r.scope(" AND "); got != tt.wantScope {
+			t.Errorf("%s: scope = %q, want %q", tt.name, got, tt.wantScope)
+		}
+		if got := r.where(tt.condition); got != tt.wantWhere {
+			t.Errorf("%s: where = %q, want %q", tt.name, got, tt.wantWhere)
+		}
+	}
+}
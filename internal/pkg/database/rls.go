@@ -0,0 +1,78 @@
+package database
+
+import (
+	"context"
+	"fmt"
+	"go-starter-kit/internal/pkg/jwt"
+	"go-starter-kit/internal/server/config"
+	"strconv"
+	"strings"
+)
+
+// sessionVariables are the settings every request transaction starts with,
+// taken from the validated jwt.UserClaims and the verified tenant in the
+// context, so row-level security policies can read them, e.g.
+//
+//	CREATE POLICY own_rows ON orders
+//		USING (uid = current_setting('app.uid', true)::bigint);
+//
+// They are set with set_config(..., true), the equivalent of SET LOCAL, and
+// end with the transaction, so a pooled session never carries them over to
+// another request. When a context has any of them, its reads share a
+// read-only transaction set up the same way, on the replica they would have
+// gone to, until a write opens the request transaction; a context without a
+// TransactionCtx gets ErrSessionNeedsTx. A nil *sessionVariables sets
+// nothing.
+type sessionVariables struct {
+	uid       string
+	userID    string
+	appID     string
+	sessionID string
+	tenant    string
+}
+
+func newSessionVariables(conf config.SessionVariables) (*sessionVariables, error) {
+	v := &sessionVariables{
+		uid:       conf.UID,
+		userID:    conf.UserID,
+		appID:     conf.APPID,
+		sessionID: conf.SessionID,
+		tenant:    conf.Tenant,
+	}
+	if *v == (sessionVariables{}) {
+		return nil, nil
+	}
+	for _, name := range []string{v.uid, v.userID, v.appID, v.sessionID, v.tenant} {
+		// Postgres only accepts custom settings with a prefix, such as app.uid.
+		if name != "" && !strings.Contains(name, ".") {
+			return nil, fmt.Errorf("session variable %q must be qualified, e.g. app.%s", name, name)
+		}
+	}
+	return v, nil
+}
+
+// appendTo adds the variables that have a value in ctx to names and values,
+// which setupSession applies in a single round trip.
+func (v *sessionVariables) appendTo(ctx context.Context, names, values []string) ([]string, []string) {
+	if v == nil {
+		return names, values
+	}
+	add := func(name, value string) {
+		if name != "" {
+			names = append(names, name)
+			values = append(values, value)
+		}
+	}
+	if claims, ok := jwt.UserClaimsFromCtx(ctx); ok {
+		add(v.uid, strconv.FormatInt(claims.UID, 10))
+		add(v.userID, claims.Id)
+		add(v.appID, claims.APPID)
+		add(v.sessionID, strconv.FormatInt(claims.SessionID, 10))
+	}
+	// A tenant only named by the client must not pass for the one policies
+	// isolate on.
+	if tenant, ok := VerifiedTenantFromCtx(ctx); ok {
+		add(v.tenant, tenant)
+	}
+	return names, values
+}
@@ -0,0 +1,118 @@
+package database
+
+import (
+	"database/sql"
+	"github.com/jackc/pgx/v4/pgxpool"
+	"time"
+)
+
+type Status struct {
+	MasterBreaker    BreakerState    `json:"master_breaker"`
+	Replicas         []ReplicaStatus `json:"replicas"`
+	ReadsFromPrimary bool            `json:"reads_from_primary"`
+}
+
+type ReplicaStatus struct {
+	Name    string       `json:"name"`
+	Healthy bool         `json:"healthy"`
+	LagMs   int64        `json:"lag_ms"`
+	Lagging bool         `json:"lagging"`
+	Breaker BreakerState `json:"breaker"`
+}
+
+// Status reports the last known state of every replica as seen by the
+// background health check, and the state of every circuit breaker. It does
+// not touch the network.
+func (p *Postgres) Status() Status {
+	status := Status{
+		MasterBreaker:    p.writeBreaker.State(),
+		Replicas:         make([]ReplicaStatus, 0, len(p.replicas)),
+		ReadsFromPrimary: true,
+	}
+	for _, r := range p.replicas {
+		status.Replicas = append(status.Replicas, ReplicaStatus{
+			Name:    r.name,
+			Healthy: r.healthy.Load(),
+			LagMs:   time.Duration(r.lag.Load()).Milliseconds(),
+			Lagging: r.lagging.Load(),
+			Breaker: r.breaker.State(),
+		})
+		if r.usable(p.maxReplicationLag) && r.breaker.State() != BreakerOpen {
+			status.ReadsFromPrimary = false
+		}
+	}
+	return status
+}
+
+type Stats struct {
+	Write    PoolStats   `json:"write"`
+	Replicas []PoolStats `json:"replicas"`
+}
+
+// PoolStats is sql.DBStats of one instance, with durations in milliseconds.
+// Native is set when the pgxpool driver gives the instance a second pool.
+type PoolStats struct {
+	Name               string `json:"name"`
+	MaxOpenConnections int    `json:"max_open_connections"`
+	OpenConnections    int    `json:"open_connections"`
+	InUse              int    `json:"in_use"`
+	Idle               int    `json:"idle"`
+	WaitCount          int64  `json:"wait_count"`
+	WaitDurationMs     int64  `json:"wait_duration_ms"`
+	MaxIdleClosed      int64  `json:"max_idle_closed"`
+	MaxIdleTimeClosed  int64  `json:"max_idle_time_closed"`
+	MaxLifetimeClosed  int64  `json:"max_lifetime_closed"`
+
+	Native *NativePoolStats `json:"native,omitempty"`
+}
+
+// NativePoolStats is pgxpool.Stat, with durations in milliseconds.
+type NativePoolStats struct {
+	MaxConns          int32 `json:"max_conns"`
+	TotalConns        int32 `json:"total_conns"`
+	AcquiredConns     int32 `json:"acquired_conns"`
+	IdleConns         int32 `json:"idle_conns"`
+	AcquireCount      int64 `json:"acquire_count"`
+	EmptyAcquireCount int64 `json:"empty_acquire_count"`
+	AcquireDurationMs int64 `json:"acquire_duration_ms"`
+}
+
+func newPoolStats(name string, s sql.DBStats, native *pgxpool.Pool) PoolStats {
+	stats := PoolStats{
+		Name:               name,
+		MaxOpenConnections: s.MaxOpenConnections,
+		OpenConnections:    s.OpenConnections,
+		InUse:              s.InUse,
+		Idle:               s.Idle,
+		WaitCount:          s.WaitCount,
+		WaitDurationMs:     s.WaitDuration.Milliseconds(),
+		MaxIdleClosed:      s.MaxIdleClosed,
+		MaxIdleTimeClosed:  s.MaxIdleTimeClosed,
+		MaxLifetimeClosed:  s.MaxLifetimeClosed,
+	}
+	if native != nil {
+		ns := native.Stat()
+		stats.Native = &NativePoolStats{
+			MaxConns:          ns.MaxConns(),
+			TotalConns:        ns.TotalConns(),
+			AcquiredConns:     ns.AcquiredConns(),
+			IdleConns:         ns.IdleConns(),
+			AcquireCount:      ns.AcquireCount(),
+			EmptyAcquireCount: ns.EmptyAcquireCount(),
+			AcquireDurationMs: ns.AcquireDuration().Milliseconds(),
+		}
+	}
+	return stats
+}
+
+// Stats snapshots the connection pool statistics of master and every replica.
+func (p *Postgres) Stats() Stats {
+	stats := Stats{
+		Write:    newPoolStats("master", p.writeDB.Stats(), p.writeNative),
+		Replicas: make([]PoolStats, 0, len(p.replicas)),
+	}
+	for _, r := range p.replicas {
+		stats.Replicas = append(stats.Replicas, newPoolStats(r.name, r.db.Stats(), r.native))
+	}
+	return stats
+}
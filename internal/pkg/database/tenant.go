@@ -0,0 +1,411 @@
+package database
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/jackc/pgx/v4"
+	"github.com/jmoiron/sqlx"
+	"go-starter-kit/internal/log"
+	"go-starter-kit/internal/server/config"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	defaultTenantIdleTimeout = 10 * time.Minute
+	defaultTenantMaxPools    = 16
+)
+
+var (
+	ErrUnknownTenant = errors.New("unknown tenant")
+	ErrInvalidTenant = errors.New("invalid tenant id")
+	// ErrTooManyTenants is returned when every tenant pool allowed by
+	// Tenancy.MaxPools is open and busy.
+	ErrTooManyTenants = errors.New("too many tenant pools open")
+	// ErrSessionNeedsTx is returned for a context whose tenant schema or
+	// session variables can only be applied inside a transaction but that
+	// carries no TransactionCtx, e.g. in a background job. Run the work in
+	// RunInTx.
+	ErrSessionNeedsTx = errors.New("session setup needs a transaction")
+)
+
+var tenantIDPattern = regexp.MustCompile(`^[A-Za-z0-9_-]{1,63}$`)
+
+type TenantCtxKeyType string
+
+const (
+	TenantCtxKey TenantCtxKeyType = "tenant"
+)
+
+type tenantCtxValue struct {
+	id       string
+	verified bool
+}
+
+// WithTenant routes every connection taken with the returned context to the
+// pools or schema of tenant. The tenant is taken as unverified, e.g. named by
+// a request without a token.
+func WithTenant(ctx context.Context, tenant string) context.Context {
+	return context.WithValue(ctx, TenantCtxKey, tenantCtxValue{id: tenant})
+}
+
+// WithVerifiedTenant is WithTenant for a tenant checked against the
+// validated claims of the request.
+func WithVerifiedTenant(ctx context.Context, tenant string) context.Context {
+	return context.WithValue(ctx, TenantCtxKey, tenantCtxValue{id: tenant, verified: true})
+}
+
+func TenantFromCtx(ctx context.Context) (string, bool) {
+	tenant, ok := ctx.Value(TenantCtxKey).(tenantCtxValue)
+	return tenant.id, ok && tenant.id != ""
+}
+
+// VerifiedTenantFromCtx only reports a tenant set by WithVerifiedTenant.
+func VerifiedTenantFromCtx(ctx context.Context) (string, bool) {
+	tenant, ok := ctx.Value(TenantCtxKey).(tenantCtxValue)
+	return tenant.id, ok && tenant.id != "" && tenant.verified
+}
+
+func ValidTenantID(id string) bool {
+	return tenantIDPattern.MatchString(id)
+}
+
+// tenantRegistry resolves tenants. Only tenants listed in Tenancy.Tenants
+// are known, plus any other when Tenancy.AllowUnlisted is set.
+//
+// A tenant with its own Database gets a *Postgres of its own, opened by its
+// first request and closed once idle for idleTimeout; at most maxPools of
+// them are open at once. Every other tenant shares the pools of the parent
+// and lives in its own schema: each transaction opened for it starts with
+// search_path set to that schema, see setupSession.
+type tenantRegistry struct {
+	parent        *Postgres
+	conf          *config.Config
+	logger        log.Logger
+	tenants       map[string]config.TenantConfig
+	allowUnlisted bool
+	schemaFormat  string
+	maxOpen       int
+	maxPools      int
+	idleTimeout   time.Duration
+
+	mu      sync.Mutex
+	entries map[string]*tenantEntry
+}
+
+type tenantEntry struct {
+	once     sync.Once
+	postgres *Postgres
+	err      error
+	lastUsed time.Time
+	// refs counts the transaction scopes using the pools, which are not
+	// evicted while it is above zero, even between two statements.
+	refs int
+}
+
+func newTenantRegistry(parent *Postgres, conf *config.Config, logger log.Logger) (*tenantRegistry, error) {
+	tenancy := conf.Tenancy
+	if tenancy.SchemaFormat != "" && strings.Count(tenancy.SchemaFormat, "%s") != 1 {
+		return nil, fmt.Errorf("tenancy schema format %q must contain %%s once", tenancy.SchemaFormat)
+	}
+	tenants := make(map[string]config.TenantConfig, len(tenancy.Tenants))
+	for _, tenant := range tenancy.Tenants {
+		if !ValidTenantID(tenant.ID) {
+			return nil, fmt.Errorf("%w %q in tenancy config", ErrInvalidTenant, tenant.ID)
+		}
+		tenants[tenant.ID] = tenant
+	}
+	idleTimeout := time.Duration(tenancy.IdleTimeout) * time.Second
+	if idleTimeout <= 0 {
+		idleTimeout = defaultTenantIdleTimeout
+	}
+	maxPools := tenancy.MaxPools
+	if maxPools <= 0 {
+		maxPools = defaultTenantMaxPools
+	}
+	return &tenantRegistry{
+		parent:        parent,
+		conf:          conf,
+		logger:        logger.WithPrefix("tenant"),
+		tenants:       tenants,
+		allowUnlisted: tenancy.AllowUnlisted,
+		schemaFormat:  tenancy.SchemaFormat,
+		maxOpen:       tenancy.MaxOpen,
+		maxPools:      maxPools,
+		idleTimeout:   idleTimeout,
+		entries:       make(map[string]*tenantEntry),
+	}, nil
+}
+
+func hasOwnDatabase(tenant config.TenantConfig) bool {
+	return tenant.Database.DSN != "" || tenant.Database.Host != ""
+}
+
+// forTenant returns the Postgres serving the tenant of ctx: the tenant's own
+// for a tenant with its own database, p itself otherwise. The TransactionCtx
+// of ctx keeps the tenant's pools open until it ends.
+func (p *Postgres) forTenant(ctx context.Context) (*Postgres, error) {
+	if p.tenants == nil {
+		return p, nil
+	}
+	tenant, ok := TenantFromCtx(ctx)
+	if !ok {
+		return p, nil
+	}
+	holder, _ := ctx.Value(TransactionCtxKey).(*TransactionCtx)
+	return p.tenants.get(tenant, holder)
+}
+
+// tenantSchema returns the schema of the tenant of ctx when it shares the
+// pools of p.
+func (p *Postgres) tenantSchema(ctx context.Context) (string, bool) {
+	if p.tenants == nil {
+		return "", false
+	}
+	id, ok := TenantFromCtx(ctx)
+	if !ok {
+		return "", false
+	}
+	tenant, known := p.tenants.lookup(id)
+	if !known || hasOwnDatabase(tenant) {
+		return "", false
+	}
+	if tenant.Schema != "" {
+		return tenant.Schema, true
+	}
+	if p.tenants.schemaFormat != "" {
+		return fmt.Sprintf(p.tenants.schemaFormat, id), true
+	}
+	return id, true
+}
+
+// sessionSettings returns the settings the transactions of ctx start with:
+// the search_path of the tenant schema and the session variables.
+func (p *Postgres) sessionSettings(ctx context.Context) (names, values []string) {
+	if schema, ok := p.tenantSchema(ctx); ok {
+		names = append(names, "search_path")
+		values = append(values, pgx.Identifier{schema}.Sanitize())
+	}
+	return p.sessionVars.appendTo(ctx, names, values)
+}
+
+// needsSession reports whether statements of ctx must run in a transaction
+// opened with setupSession to see the right data, or to be seen by row-level
+// security policies as the right user.
+func (p *Postgres) needsSession(ctx context.Context) bool {
+	names, _ := p.sessionSettings(ctx)
+	return len(names) > 0
+}
+
+// setupSession runs right after BEGIN of every transaction p opens and
+// applies sessionSettings with set_config(..., true), the equivalent of SET
+// LOCAL, so nothing outlives the transaction on the pooled session.
+func (p *Postgres) setupSession(ctx context.Context, tx *sqlx.Tx) error {
+	names, values := p.sessionSettings(ctx)
+	if len(names) == 0 {
+		return nil
+	}
+
+	_, err := tx.ExecContext(ctx,
+		"SELECT set_config(s.name, s.value, true) FROM unnest($1::text[], $2::text[]) AS s(name, value)",
+		names, values)
+	if err != nil {
+		return fmt.Errorf("set up session failed: %w", err)
+	}
+	return nil
+}
+
+// lookup returns the config of a known tenant; an allowed unlisted one has
+// only its ID set.
+func (t *tenantRegistry) lookup(id string) (config.TenantConfig, bool) {
+	if tenant, listed := t.tenants[id]; listed {
+		return tenant, true
+	}
+	return config.TenantConfig{ID: id}, t.allowUnlisted
+}
+
+// get returns the Postgres of tenant id, opening its pools if needed. When
+// holder is set, the pools stay open until it ends; otherwise only while a
+// connection is checked out.
+func (t *tenantRegistry) get(id string, holder *TransactionCtx) (*Postgres, error) {
+	if !ValidTenantID(id) {
+		return nil, fmt.Errorf("%w %q", ErrInvalidTenant, id)
+	}
+	tenant, known := t.lookup(id)
+	if !known {
+		return nil, fmt.Errorf("%w %q", ErrUnknownTenant, id)
+	}
+	if !hasOwnDatabase(tenant) {
+		return t.parent, nil
+	}
+
+	t.mu.Lock()
+	entry, ok := t.entries[id]
+	var evicted *Postgres
+	if !ok {
+		if len(t.entries) >= t.maxPools {
+			if evicted = t.evictLeastRecentlyUsed(); evicted == nil {
+				t.mu.Unlock()
+				return nil, fmt.Errorf("tenant %s: %w (%d)", id, ErrTooManyTenants, t.maxPools)
+			}
+		}
+		entry = &tenantEntry{}
+		t.entries[id] = entry
+	}
+	entry.lastUsed = time.Now()
+	entry.refs++
+	t.mu.Unlock()
+	if evicted != nil {
+		evicted.Shutdown()
+	}
+
+	// Only this tenant waits for its pools to open.
+	entry.once.Do(func() {
+		postgres, err := t.open(tenant)
+		t.mu.Lock()
+		entry.postgres, entry.err = postgres, err
+		t.mu.Unlock()
+	})
+	if entry.err != nil {
+		t.mu.Lock()
+		entry.refs--
+		if t.entries[id] == entry {
+			delete(t.entries, id)
+		}
+		t.mu.Unlock()
+		return nil, fmt.Errorf("tenant %s: %w", id, entry.err)
+	}
+	if holder == nil || !holder.holdTenant(id, func() { t.release(entry) }) {
+		t.release(entry)
+	}
+	return entry.postgres, nil
+}
+
+// release drops a reference taken by get.
+func (t *tenantRegistry) release(entry *tenantEntry) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	entry.refs--
+	entry.lastUsed = time.Now()
+}
+
+// evictLeastRecentlyUsed makes room for another tenant by dropping the idle
+// one used longest ago, held by no transaction scope, and returns its
+// Postgres for the caller to shut down outside t.mu, or nil when every open
+// tenant is busy. Callers hold t.mu.
+func (t *tenantRegistry) evictLeastRecentlyUsed() *Postgres {
+	var (
+		oldestID string
+		oldest   *tenantEntry
+	)
+	for id, entry := range t.entries {
+		if entry.postgres == nil || entry.refs > 0 || entry.postgres.inUse() {
+			continue
+		}
+		if oldest == nil || entry.lastUsed.Before(oldest.lastUsed) {
+			oldestID, oldest = id, entry
+		}
+	}
+	if oldest == nil {
+		return nil
+	}
+	delete(t.entries, oldestID)
+	t.logger.Infof("closing pools of tenant %s to make room for another tenant", oldestID)
+	return oldest.postgres
+}
+
+func (t *tenantRegistry) open(tenant config.TenantConfig) (*Postgres, error) {
+	conf := *t.conf
+	conf.Tenancy.Enabled = false
+	pgConf := &conf.Connection.Postgresql
+	// A tenant that cannot connect fails its request rather than stalling it
+	// through the whole startup retry.
+	pgConf.StartupRetry.MaxAttempts = 1
+
+	inst := tenant.Database
+	inst.Name = tenant.ID + "/master"
+	if t.maxOpen > 0 && (inst.MaxOpen <= 0 || inst.MaxOpen > t.maxOpen) {
+		inst.MaxOpen = t.maxOpen
+	}
+	pgConf.Master = inst
+	pgConf.Replicas = nil
+	pgConf.FixedReadInstance = ""
+
+	postgres, err := NewPostgres(&conf, t.logger)
+	if err != nil {
+		return nil, err
+	}
+	// Tenant pools report to the same hooks as the shared ones.
+	t.parent.hooksMu.RLock()
+	postgres.hooks = t.parent.hooks
+	t.parent.hooksMu.RUnlock()
+
+	t.logger.Infof("opened pools of tenant %s", tenant.ID)
+	return postgres, nil
+}
+
+func (p *Postgres) runTenantEviction() {
+	defer p.wg.Done()
+
+	ticker := time.NewTicker(p.tenants.idleTimeout / 2)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-p.done:
+			return
+		case <-ticker.C:
+			p.tenants.evictIdle()
+		}
+	}
+}
+
+// evictIdle closes the pools of tenants that have not been used for
+// idleTimeout, with no transaction scope holding them and no connection
+// checked out.
+func (t *tenantRegistry) evictIdle() {
+	var evicted []*Postgres
+	t.mu.Lock()
+	for id, entry := range t.entries {
+		if entry.postgres == nil || entry.refs > 0 || time.Since(entry.lastUsed) < t.idleTimeout || entry.postgres.inUse() {
+			continue
+		}
+		delete(t.entries, id)
+		evicted = append(evicted, entry.postgres)
+		t.logger.Infof("closing pools of tenant %s after %s idle", id, t.idleTimeout)
+	}
+	t.mu.Unlock()
+
+	for _, postgres := range evicted {
+		postgres.Shutdown()
+	}
+}
+
+func (t *tenantRegistry) shutdown() {
+	t.mu.Lock()
+	entries := t.entries
+	t.entries = make(map[string]*tenantEntry)
+	t.mu.Unlock()
+
+	for _, entry := range entries {
+		entry.once.Do(func() {})
+		if entry.postgres != nil {
+			entry.postgres.Shutdown()
+		}
+	}
+}
+
+func (p *Postgres) inUse() bool {
+	if poolInUse(p.writeDB, p.writeNative) > 0 {
+		return true
+	}
+	for _, r := range p.replicas {
+		if r.inUse() > 0 {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,81 @@
+package database
+
+import (
+	"context"
+	"go-starter-kit/internal/server/config"
+	"testing"
+	"time"
+)
+
+// TestTenantHeldUntilEnd checks that the pools of a tenant used by a
+// transaction scope are not evicted before it ends, even with no connection
+// checked out in between.
+func TestTenantHeldUntilEnd(t *testing.T) {
+	p, _ := newFakePostgres(t)
+	conf := &config.Config{}
+	conf.Tenancy.Enabled = true
+	conf.Tenancy.Tenants = []config.TenantConfig{{ID: "acme", Database: config.PostgresqlInstance{Host: "acme.internal"}}}
+	var err error
+	if p.tenants, err = newTenantRegistry(p, conf, p.logger); err != nil {
+		t.Fatal(err)
+	}
+	p.tenants.idleTimeout = time.Nanosecond
+	tenant, _ := newFakePostgres(t)
+	entry := &tenantEntry{postgres: tenant}
+	entry.once.Do(func() {})
+	p.tenants.entries["acme"] = entry
+	refs := func() int {
+		p.tenants.mu.Lock()
+		defer p.tenants.mu.Unlock()
+		return entry.refs
+	}
+
+	// Without a transaction scope nothing holds the pools.
+	if _, err := p.forTenant(WithTenant(context.Background(), "acme")); err != nil {
+		t.Fatal(err)
+	}
+	if got := refs(); got != 0 {
+		t.Fatalf("refs without a TransactionCtx = %d, want 0", got)
+	}
+
+	request := &TransactionCtx{}
+	ctx := WithTenant(context.WithValue(context.Background(), TransactionCtxKey, request), "acme")
+	for i := 0; i < 2; i++ {
+		got, err := p.forTenant(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got != tenant {
+			t.Fatal("forTenant did not return the tenant's Postgres")
+		}
+	}
+	if got := refs(); got != 1 {
+		t.Fatalf("refs during the request = %d, want 1", got)
+	}
+
+	p.tenants.evictIdle()
+	p.tenants.mu.Lock()
+	evicted := p.tenants.evictLeastRecentlyUsed()
+	_, open := p.tenants.entries["acme"]
+	p.tenants.mu.Unlock()
+	if !open || evicted != nil {
+		t.Fatal("tenant evicted while a request holds it")
+	}
+
+	if err := request.End(ctx, nil); err != nil {
+		t.Fatal(err)
+	}
+	if got := refs(); got != 0 {
+		t.Fatalf("refs after End = %d, want 0", got)
+	}
+	time.Sleep(time.Millisecond)
+	p.tenants.evictIdle()
+	if _, open := p.tenants.entries["acme"]; open {
+		t.Error("idle tenant not evicted after the request ended")
+	}
+	select {
+	case <-tenant.done:
+	default:
+		t.Error("evicted tenant not shut down")
+	}
+}
@@ -0,0 +1,166 @@
+package database
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math/rand"
+	"time"
+)
+
+// txRetryDefaults apply to RunInTx, startupRetryDefaults to the connects of
+// NewPostgres, which have to ride out a database that is still starting.
+var (
+	txRetryDefaults = retryPolicy{
+		maxAttempts:    3,
+		initialBackoff: 50 * time.Millisecond,
+		maxBackoff:     time.Second,
+	}
+	startupRetryDefaults = retryPolicy{
+		maxAttempts:    10,
+		initialBackoff: 500 * time.Millisecond,
+		maxBackoff:     10 * time.Second,
+	}
+)
+
+type retryPolicy struct {
+	maxAttempts    int
+	initialBackoff time.Duration
+	maxBackoff     time.Duration
+}
+
+func newRetryPolicy(maxAttempts, initialBackoffMs, maxBackoffMs int, defaults retryPolicy) retryPolicy {
+	r := retryPolicy{
+		maxAttempts:    maxAttempts,
+		initialBackoff: time.Duration(initialBackoffMs) * time.Millisecond,
+		maxBackoff:     time.Duration(maxBackoffMs) * time.Millisecond,
+	}
+	if r.maxAttempts <= 0 {
+		r.maxAttempts = defaults.maxAttempts
+	}
+	if r.initialBackoff <= 0 {
+		r.initialBackoff = defaults.initialBackoff
+	}
+	if r.maxBackoff <= 0 {
+		r.maxBackoff = defaults.maxBackoff
+	}
+	return r
+}
+
+func (r retryPolicy) backoff(attempt int) time.Duration {
+	d := r.initialBackoff << (attempt - 1)
+	if d <= 0 || d > r.maxBackoff {
+		d = r.maxBackoff
+	}
+	half := d / 2
+	return half + time.Duration(rand.Int63n(int64(half)+1))
+}
+
+func isRetryable(err error) bool {
+	return errors.Is(TranslateError(err), ErrSerialization)
+}
+
+// RunInTx runs fn inside a transaction obtained via GetWriteConnection and
+// commits it when fn returns nil. Serialization failures and deadlocks roll
+// the transaction back and run fn again, so fn must not have side effects
+// outside the database.
+//
+// When ctx carries a TransactionCtx, such as the request transaction, fn
+// always joins it, opening it first if needed, and runs in a savepoint: an
+// error only undoes fn's own work, while everything fn did commits or rolls
+// back with the outer transaction, whatever ran before it. The outer owner
+// decides when to commit, so nothing is retried then, and opts may only be
+// given while the outer transaction has not been opened yet. Use RunInNewTx
+// to commit fn on its own, with retries, from within a request.
+func (p *Postgres) RunInTx(ctx context.Context, opts *TxOptions, fn func(ctx context.Context, conn Conn) error) error {
+	if outer, _ := ctx.Value(TransactionCtxKey).(*TransactionCtx); outer != nil {
+		if opts != nil {
+			if err := joinTxOptions(outer, opts); err != nil {
+				return err
+			}
+		}
+		nestedCtx, err := p.Begin(ctx)
+		if err != nil {
+			return err
+		}
+		return p.runInTx(nestedCtx, nestedCtx.Value(TransactionCtxKey).(*TransactionCtx), fn)
+	}
+	_, err := p.retryInTx(ctx, opts, fn)
+	return err
+}
+
+// RunInNewTx is RunInTx for a transaction of its own even when ctx carries
+// one, e.g. inside a request, which the Tx middleware always wraps in the
+// request transaction. fn commits or rolls back on its own connection before
+// RunInNewTx returns and is retried like RunInTx without an outer
+// transaction. It does not see what the outer transaction has not committed
+// yet, and once it has committed, the outer context counts as Committed so
+// its later reads and the sticky window account for the write.
+func (p *Postgres) RunInNewTx(ctx context.Context, opts *TxOptions, fn func(ctx context.Context, conn Conn) error) error {
+	committed, err := p.retryInTx(ctx, opts, fn)
+	if outer, _ := ctx.Value(TransactionCtxKey).(*TransactionCtx); outer != nil && committed {
+		outer.markCommitted()
+	}
+	return err
+}
+
+// retryInTx runs fn in a new transaction until it commits, fails for good or
+// runs out of attempts, and reports whether it committed a write.
+func (p *Postgres) retryInTx(ctx context.Context, opts *TxOptions, fn func(ctx context.Context, conn Conn) error) (bool, error) {
+	for attempt := 1; ; attempt++ {
+		transactionCtx := &TransactionCtx{Options: opts}
+		err := p.runInTx(context.WithValue(ctx, TransactionCtxKey, transactionCtx), transactionCtx, fn)
+		if err == nil {
+			return transactionCtx.Committed(), nil
+		}
+		if !isRetryable(err) || attempt >= p.retry.maxAttempts {
+			return false, err
+		}
+
+		delay := p.retry.backoff(attempt)
+		p.logger.Warnf("postgres: retrying transaction in %s (attempt %d/%d): %s",
+			delay, attempt+1, p.retry.maxAttempts, err)
+		timer := time.NewTimer(delay)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return false, err
+		case <-timer.C:
+		}
+	}
+}
+
+// joinTxOptions declares opts on the outer transaction fn joins. Once it is
+// open its options cannot change, so differing ones are an error.
+func joinTxOptions(outer *TransactionCtx, opts *TxOptions) error {
+	outer.Mu.Lock()
+	defer outer.Mu.Unlock()
+	if outer.Conn == nil && outer.parent == nil {
+		outer.Options = opts
+		return nil
+	}
+	if outer.Options == nil || *outer.Options != *opts {
+		return fmt.Errorf("run in tx: %w with other options", ErrTxAlreadyStarted)
+	}
+	return nil
+}
+
+func (p *Postgres) runInTx(ctx context.Context, transactionCtx *TransactionCtx, fn func(ctx context.Context, conn Conn) error) error {
+	defer func() {
+		if r := recover(); r != nil {
+			_ = transactionCtx.End(ctx, fmt.Errorf("panic: %v", r))
+			panic(r)
+		}
+	}()
+
+	conn, err := p.GetWriteConnection(ctx)
+	if err != nil {
+		_ = transactionCtx.End(ctx, err)
+		return err
+	}
+	if err := fn(ctx, conn); err != nil {
+		_ = transactionCtx.End(ctx, err)
+		return err
+	}
+	return transactionCtx.End(ctx, nil)
+}
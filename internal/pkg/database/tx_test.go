@@ -0,0 +1,93 @@
+package database
+
+import (
+	"context"
+	"errors"
+	"github.com/jackc/pgconn"
+	"testing"
+	"time"
+)
+
+func TestNewRetryPolicy(t *testing.T) {
+	if got := newRetryPolicy(0, 0, 0, txRetryDefaults); got != txRetryDefaults {
+		t.Errorf("zero config = %+v, want the defaults %+v", got, txRetryDefaults)
+	}
+	want := retryPolicy{maxAttempts: 5, initialBackoff: 10 * time.Millisecond, maxBackoff: 2 * time.Second}
+	if got := newRetryPolicy(5, 10, 2000, startupRetryDefaults); got != want {
+		t.Errorf("newRetryPolicy(5, 10, 2000) = %+v, want %+v", got, want)
+	}
+}
+
+func TestRetryPolicyBackoff(t *testing.T) {
+	r := retryPolicy{maxAttempts: 10, initialBackoff: 100 * time.Millisecond, maxBackoff: time.Second}
+	tests := []struct {
+		attempt int
+		ceiling time.Duration
+	}{
+		{attempt: 1, ceiling: 100 * time.Millisecond},
+		{attempt: 2, ceiling: 200 * time.Millisecond},
+		{attempt: 4, ceiling: 800 * time.Millisecond},
+		{attempt: 5, ceiling: time.Second},
+		// The shift overflows long before this; it must still cap.
+		{attempt: 70, ceiling: time.Second},
+	}
+	for _, tt := range tests {
+		for i := 0; i < 100; i++ {
+			if got := r.backoff(tt.attempt); got < tt.ceiling/2 || got > tt.ceiling {
+				t.Fatalf("backoff(%d) = %s, want within [%s, %s]", tt.attempt, got, tt.ceiling/2, tt.ceiling)
+			}
+		}
+	}
+}
+
+// TestRunInNewTxRetries checks that RunInNewTx retries serialization
+// failures inside a request, whose transaction RunInTx would join instead.
+func TestRunInNewTxRetries(t *testing.T) {
+	tests := []struct {
+		name          string
+		failures      int
+		wantErr       error
+		wantCalls     int
+		wantCommitted bool
+	}{
+		{name: "succeeds after retries", failures: 2, wantCalls: 3, wantCommitted: true},
+		{name: "out of attempts", failures: 3, wantErr: ErrSerialization, wantCalls: 3},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p, fake := newFakePostgres(t)
+			request := &TransactionCtx{}
+			ctx := context.WithValue(context.Background(), TransactionCtxKey, request)
+
+			calls := 0
+			err := p.RunInNewTx(ctx, nil, func(ctx context.Context, conn Conn) error {
+				calls++
+				if calls <= tt.failures {
+					return &pgconn.PgError{Severity: "ERROR", Code: "40001"}
+				}
+				return nil
+			})
+			if !errors.Is(TranslateError(err), tt.wantErr) {
+				t.Fatalf("RunInNewTx() error = %v, want %v", err, tt.wantErr)
+			}
+			if calls != tt.wantCalls {
+				t.Errorf("fn ran %d times, want %d", calls, tt.wantCalls)
+			}
+
+			var want []string
+			for i := 0; i < tt.failures; i++ {
+				want = append(want, "BEGIN", "ROLLBACK")
+			}
+			if tt.wantErr == nil {
+				want = append(want, "BEGIN", "COMMIT")
+			}
+			wantStatements(t, fake, want...)
+			if request.Active() {
+				t.Error("RunInNewTx opened the request transaction")
+			}
+			if got := request.Committed(); got != tt.wantCommitted {
+				t.Errorf("request Committed() = %v, want %v", got, tt.wantCommitted)
+			}
+		})
+	}
+}
@@ -0,0 +1,18 @@
+package jwt
+
+import "context"
+
+type UserClaimsCtxKeyType string
+
+const (
+	UserClaimsCtxKey UserClaimsCtxKeyType = "user_claims"
+)
+
+func WithUserClaims(ctx context.Context, claims *UserClaims) context.Context {
+	return context.WithValue(ctx, UserClaimsCtxKey, claims)
+}
+
+func UserClaimsFromCtx(ctx context.Context) (*UserClaims, bool) {
+	claims, ok := ctx.Value(UserClaimsCtxKey).(*UserClaims)
+	return claims, ok && claims != nil
+}
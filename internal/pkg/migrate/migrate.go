@@ -0,0 +1,350 @@
+package migrate
+
+import (
+	"context"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"github.com/jmoiron/sqlx"
+	"go-starter-kit/internal/log"
+	"io/fs"
+	"regexp"
+	"sort"
+	"strconv"
+	"time"
+)
+
+// lockKey is the pg_advisory_lock key every instance of the service takes
+// before touching the schema, so pods starting together run migrations one
+// at a time.
+const lockKey int64 = 7271846201
+
+const createTableQuery = `CREATE TABLE IF NOT EXISTS schema_migrations (
+	version    BIGINT PRIMARY KEY,
+	name       TEXT        NOT NULL,
+	checksum   TEXT        NOT NULL,
+	applied_at TIMESTAMPTZ NOT NULL DEFAULT now()
+)`
+
+var fileNamePattern = regexp.MustCompile(`^(\d+)_(.+)\.(up|down)\.sql$`)
+
+var ErrChecksumMismatch = errors.New("migration changed after it was applied")
+
+type Migration struct {
+	Version  int64
+	Name     string
+	Up       string
+	Down     string
+	Checksum string
+}
+
+type State string
+
+const (
+	StateApplied  State = "applied"
+	StatePending  State = "pending"
+	StateModified State = "modified"
+	StateMissing  State = "missing"
+)
+
+type MigrationStatus struct {
+	Version   int64
+	Name      string
+	State     State
+	AppliedAt *time.Time
+}
+
+type appliedMigration struct {
+	Version   int64     `db:"version"`
+	Name      string    `db:"name"`
+	Checksum  string    `db:"checksum"`
+	AppliedAt time.Time `db:"applied_at"`
+}
+
+type Migrator struct {
+	db         *sqlx.DB
+	logger     log.Logger
+	migrations []Migration
+}
+
+func NewMigrator(db *sqlx.DB, logger log.Logger, fsys fs.FS) (*Migrator, error) {
+	migrations, err := Load(fsys)
+	if err != nil {
+		return nil, err
+	}
+	return &Migrator{
+		db:         db,
+		logger:     logger.WithPrefix("migrate"),
+		migrations: migrations,
+	}, nil
+}
+
+// Load reads every migration in the root of fsys, ordered by version. Every
+// version needs an up file; the down file is optional.
+func Load(fsys fs.FS) ([]Migration, error) {
+	entries, err := fs.ReadDir(fsys, ".")
+	if err != nil {
+		return nil, fmt.Errorf("migrate: read migrations failed: %w", err)
+	}
+
+	byVersion := make(map[int64]*Migration)
+	for _, entry := range entries {
+		match := fileNamePattern.FindStringSubmatch(entry.Name())
+		if entry.IsDir() || match == nil {
+			continue
+		}
+		version, err := strconv.ParseInt(match[1], 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("migrate: bad version in %s: %w", entry.Name(), err)
+		}
+		body, err := fs.ReadFile(fsys, entry.Name())
+		if err != nil {
+			return nil, fmt.Errorf("migrate: read %s failed: %w", entry.Name(), err)
+		}
+
+		m, ok := byVersion[version]
+		if !ok {
+			m = &Migration{Version: version, Name: match[2]}
+			byVersion[version] = m
+		} else if m.Name != match[2] {
+			return nil, fmt.Errorf("migrate: version %d used by both %s and %s", version, m.Name, match[2])
+		}
+		if match[3] == "up" {
+			m.Up = string(body)
+		} else {
+			m.Down = string(body)
+		}
+	}
+
+	migrations := make([]Migration, 0, len(byVersion))
+	for _, m := range byVersion {
+		if m.Up == "" {
+			return nil, fmt.Errorf("migrate: version %d has no up migration", m.Version)
+		}
+		sum := sha256.Sum256([]byte(m.Up))
+		m.Checksum = hex.EncodeToString(sum[:])
+		migrations = append(migrations, *m)
+	}
+	sort.Slice(migrations, func(i, j int) bool {
+		return migrations[i].Version < migrations[j].Version
+	})
+	return migrations, nil
+}
+
+// Up applies up to steps pending migrations, all of them when steps <= 0.
+func (m *Migrator) Up(ctx context.Context, steps int) error {
+	return m.withLock(ctx, func(conn *sqlx.Conn) error {
+		applied, err := m.applied(ctx, conn)
+		if err != nil {
+			return err
+		}
+
+		done := 0
+		for _, migration := range m.migrations {
+			if steps > 0 && done == steps {
+				break
+			}
+			if a, ok := applied[migration.Version]; ok {
+				if a.Checksum != migration.Checksum {
+					return fmt.Errorf("migrate: %d_%s: %w", migration.Version, migration.Name, ErrChecksumMismatch)
+				}
+				continue
+			}
+			if err := m.apply(ctx, conn, migration); err != nil {
+				return err
+			}
+			done++
+		}
+		if done == 0 {
+			m.logger.Info("no pending migrations")
+		}
+		return nil
+	})
+}
+
+// Down reverts the last steps applied migrations, one when steps <= 0.
+func (m *Migrator) Down(ctx context.Context, steps int) error {
+	if steps <= 0 {
+		steps = 1
+	}
+	return m.withLock(ctx, func(conn *sqlx.Conn) error {
+		return m.down(ctx, conn, steps)
+	})
+}
+
+// Redo reverts the last applied migration and applies it again.
+func (m *Migrator) Redo(ctx context.Context) error {
+	return m.withLock(ctx, func(conn *sqlx.Conn) error {
+		applied, err := m.appliedDesc(ctx, conn)
+		if err != nil {
+			return err
+		}
+		if len(applied) == 0 {
+			return errors.New("migrate: nothing to redo")
+		}
+		migration, ok := m.find(applied[0].Version)
+		if !ok {
+			return fmt.Errorf("migrate: applied version %d has no migration file", applied[0].Version)
+		}
+		if err := m.down(ctx, conn, 1); err != nil {
+			return err
+		}
+		return m.apply(ctx, conn, migration)
+	})
+}
+
+func (m *Migrator) Status(ctx context.Context) ([]MigrationStatus, error) {
+	var statuses []MigrationStatus
+	err := m.withLock(ctx, func(conn *sqlx.Conn) error {
+		applied, err := m.applied(ctx, conn)
+		if err != nil {
+			return err
+		}
+
+		for _, migration := range m.migrations {
+			status := MigrationStatus{Version: migration.Version, Name: migration.Name, State: StatePending}
+			if a, ok := applied[migration.Version]; ok {
+				appliedAt := a.AppliedAt
+				status.AppliedAt = &appliedAt
+				status.State = StateApplied
+				if a.Checksum != migration.Checksum {
+					status.State = StateModified
+				}
+				delete(applied, migration.Version)
+			}
+			statuses = append(statuses, status)
+		}
+		for _, a := range applied {
+			appliedAt := a.AppliedAt
+			statuses = append(statuses, MigrationStatus{
+				Version:   a.Version,
+				Name:      a.Name,
+				State:     StateMissing,
+				AppliedAt: &appliedAt,
+			})
+		}
+		sort.Slice(statuses, func(i, j int) bool {
+			return statuses[i].Version < statuses[j].Version
+		})
+		return nil
+	})
+	return statuses, err
+}
+
+// withLock runs fn on a single connection holding the migration advisory
+// lock. Session-level advisory locks belong to one connection, so all work
+// must go through conn rather than the pool.
+func (m *Migrator) withLock(ctx context.Context, fn func(conn *sqlx.Conn) error) error {
+	conn, err := m.db.Connx(ctx)
+	if err != nil {
+		return fmt.Errorf("migrate: get connection failed: %w", err)
+	}
+	defer conn.Close()
+
+	if _, err := conn.ExecContext(ctx, "SELECT pg_advisory_lock($1)", lockKey); err != nil {
+		return fmt.Errorf("migrate: acquire lock failed: %w", err)
+	}
+	defer func() {
+		if _, err := conn.ExecContext(context.Background(), "SELECT pg_advisory_unlock($1)", lockKey); err != nil {
+			m.logger.Errorf("release lock failed: %s", err)
+		}
+	}()
+
+	if _, err := conn.ExecContext(ctx, createTableQuery); err != nil {
+		return fmt.Errorf("migrate: create schema_migrations failed: %w", err)
+	}
+	return fn(conn)
+}
+
+func (m *Migrator) applied(ctx context.Context, conn *sqlx.Conn) (map[int64]appliedMigration, error) {
+	rows, err := m.appliedDesc(ctx, conn)
+	if err != nil {
+		return nil, err
+	}
+	applied := make(map[int64]appliedMigration, len(rows))
+	for _, row := range rows {
+		applied[row.Version] = row
+	}
+	return applied, nil
+}
+
+func (m *Migrator) appliedDesc(ctx context.Context, conn *sqlx.Conn) ([]appliedMigration, error) {
+	var rows []appliedMigration
+	if err := conn.SelectContext(ctx, &rows,
+		"SELECT version, name, checksum, applied_at FROM schema_migrations ORDER BY version DESC"); err != nil {
+		return nil, fmt.Errorf("migrate: read schema_migrations failed: %w", err)
+	}
+	return rows, nil
+}
+
+func (m *Migrator) find(version int64) (Migration, bool) {
+	for _, migration := range m.migrations {
+		if migration.Version == version {
+			return migration, true
+		}
+	}
+	return Migration{}, false
+}
+
+func (m *Migrator) apply(ctx context.Context, conn *sqlx.Conn, migration Migration) error {
+	err := inTx(ctx, conn, func(tx *sqlx.Tx) error {
+		if _, err := tx.ExecContext(ctx, migration.Up); err != nil {
+			return err
+		}
+		_, err := tx.ExecContext(ctx,
+			"INSERT INTO schema_migrations (version, name, checksum) VALUES ($1, $2, $3)",
+			migration.Version, migration.Name, migration.Checksum)
+		return err
+	})
+	if err != nil {
+		return fmt.Errorf("migrate: up %d_%s failed: %w", migration.Version, migration.Name, err)
+	}
+	m.logger.Infof("applied %d_%s", migration.Version, migration.Name)
+	return nil
+}
+
+func (m *Migrator) down(ctx context.Context, conn *sqlx.Conn, steps int) error {
+	applied, err := m.appliedDesc(ctx, conn)
+	if err != nil {
+		return err
+	}
+	if steps > len(applied) {
+		steps = len(applied)
+	}
+
+	for _, a := range applied[:steps] {
+		migration, ok := m.find(a.Version)
+		if !ok {
+			return fmt.Errorf("migrate: applied version %d has no migration file", a.Version)
+		}
+		if migration.Down == "" {
+			return fmt.Errorf("migrate: %d_%s has no down migration", migration.Version, migration.Name)
+		}
+		err := inTx(ctx, conn, func(tx *sqlx.Tx) error {
+			if _, err := tx.ExecContext(ctx, migration.Down); err != nil {
+				return err
+			}
+			_, err := tx.ExecContext(ctx, "DELETE FROM schema_migrations WHERE version = $1", migration.Version)
+			return err
+		})
+		if err != nil {
+			return fmt.Errorf("migrate: down %d_%s failed: %w", migration.Version, migration.Name, err)
+		}
+		m.logger.Infof("reverted %d_%s", migration.Version, migration.Name)
+	}
+	return nil
+}
+
+func inTx(ctx context.Context, conn *sqlx.Conn, fn func(tx *sqlx.Tx) error) error {
+	tx, err := conn.BeginTxx(ctx, &sql.TxOptions{})
+	if err != nil {
+		return err
+	}
+	if err := fn(tx); err != nil {
+		_ = tx.Rollback()
+		return err
+	}
+	return tx.Commit()
+}
@@ -0,0 +1,75 @@
+package migrate
+
+import (
+	"go-starter-kit/migrations"
+	"strings"
+	"testing"
+	"testing/fstest"
+)
+
+func TestLoad(t *testing.T) {
+	fsys := fstest.MapFS{
+		"0010_add_index.up.sql":      {Data: []byte("CREATE INDEX ...")},
+		"0002_create_users.up.sql":   {Data: []byte("CREATE TABLE users ()")},
+		"0002_create_users.down.sql": {Data: []byte("DROP TABLE users")},
+		"README.md":                  {Data: []byte("not a migration")},
+		"0003_nested.up.sql/x":       {Data: []byte("directories are skipped")},
+	}
+	got, err := Load(fsys)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(got) != 2 {
+		t.Fatalf("loaded %d migrations, want 2: %+v", len(got), got)
+	}
+	if got[0].Version != 2 || got[0].Name != "create_users" || got[0].Down != "DROP TABLE users" {
+		t.Errorf("first migration = %+v, want 2_create_users with its down file", got[0])
+	}
+	if got[1].Version != 10 || got[1].Name != "add_index" || got[1].Down != "" {
+		t.Errorf("second migration = %+v, want 10_add_index without a down file", got[1])
+	}
+	if got[0].Checksum == "" || got[0].Checksum == got[1].Checksum {
+		t.Errorf("checksums %q and %q, want distinct ones", got[0].Checksum, got[1].Checksum)
+	}
+}
+
+func TestLoadErrors(t *testing.T) {
+	tests := []struct {
+		name string
+		fsys fstest.MapFS
+		want string
+	}{
+		{
+			name: "missing up",
+			fsys: fstest.MapFS{"0001_init.down.sql": {Data: []byte("DROP TABLE t")}},
+			want: "has no up migration",
+		},
+		{
+			name: "duplicate version",
+			fsys: fstest.MapFS{
+				"0001_init.up.sql":  {Data: []byte("CREATE TABLE t ()")},
+				"0001_other.up.sql": {Data: []byte("CREATE TABLE u ()")},
+			},
+			want: "used by both",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := Load(tt.fsys)
+			if err == nil || !strings.Contains(err.Error(), tt.want) {
+				t.Errorf("Load() error = %v, want one containing %q", err, tt.want)
+			}
+		})
+	}
+}
+
+// TestLoadEmbedded keeps the shipped migrations loadable.
+func TestLoadEmbedded(t *testing.T) {
+	got, err := Load(migrations.FS)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(got) == 0 {
+		t.Error("no migrations embedded")
+	}
+}
@@ -0,0 +1,51 @@
+package outbox
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"go-starter-kit/internal/pkg/database"
+	"time"
+)
+
+// Table is created by migrations/0001_create_outbox_events.up.sql and
+// 0002_add_outbox_next_attempt_at.up.sql.
+const Table = "outbox_events"
+
+type Event struct {
+	ID        int64           `db:"id"`
+	Topic     string          `db:"topic"`
+	Key       string          `db:"key"`
+	Payload   json.RawMessage `db:"payload"`
+	CreatedAt time.Time       `db:"created_at"`
+	Attempts  int             `db:"attempts"`
+}
+
+type Outbox struct {
+	postgres *database.Postgres
+}
+
+func New(postgres *database.Postgres) *Outbox {
+	return &Outbox{postgres: postgres}
+}
+
+// Add stores an event in the outbox through GetWriteConnection, so inside a
+// request it becomes part of the request transaction and is only relayed if
+// that transaction commits.
+func (o *Outbox) Add(ctx context.Context, topic, key string, payload interface{}) error {
+	data, err := json.Marshal(payload)
+	if err != nil {
+		return fmt.Errorf("outbox: marshal payload failed: %w", err)
+	}
+
+	conn, err := o.postgres.GetWriteConnection(ctx)
+	if err != nil {
+		return err
+	}
+	if _, err := conn.ExecContext(ctx,
+		`INSERT INTO `+Table+` (topic, key, payload) VALUES ($1, $2, $3::jsonb)`,
+		topic, key, string(data)); err != nil {
+		return fmt.Errorf("outbox: insert event failed: %w", err)
+	}
+	return nil
+}
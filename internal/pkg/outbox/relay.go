@@ -0,0 +1,198 @@
+package outbox
+
+import (
+	"context"
+	"go-starter-kit/internal/log"
+	"go-starter-kit/internal/pkg/database"
+	"go-starter-kit/internal/server/config"
+	"sort"
+	"time"
+)
+
+const (
+	defaultPollInterval   = time.Second
+	defaultBatchSize      = 100
+	defaultMaxAttempts    = 10
+	defaultInitialBackoff = time.Second
+	defaultMaxBackoff     = 5 * time.Minute
+	defaultClaimTimeout   = 30 * time.Second
+)
+
+type Publisher interface {
+	Publish(ctx context.Context, event Event) error
+}
+
+// Relay moves committed outbox events to a Publisher. Delivery is at least
+// once: a relay claims a batch, publishes it outside any transaction and only
+// then marks the events delivered, so a relay dying in between, or a claim
+// outliving ClaimTimeout, gets events published again. Consumers must be
+// idempotent, e.g. by deduplicating on Event.ID.
+//
+// Several instances can run side by side: FOR UPDATE SKIP LOCKED hands every
+// pending row to exactly one claim. A failed event waits before its next
+// attempt, with the wait doubling from InitialBackoff up to MaxBackoff, and
+// is left in the table once it reached MaxAttempts.
+type Relay struct {
+	logger         log.Logger
+	postgres       *database.Postgres
+	publisher      Publisher
+	pollInterval   time.Duration
+	batchSize      int
+	maxAttempts    int
+	initialBackoff time.Duration
+	maxBackoff     time.Duration
+	claimTimeout   time.Duration
+}
+
+func NewRelay(conf *config.Config, logger log.Logger, postgres *database.Postgres, publisher Publisher) *Relay {
+	r := &Relay{
+		logger:         logger.WithPrefix("outbox"),
+		postgres:       postgres,
+		publisher:      publisher,
+		pollInterval:   time.Duration(conf.Outbox.PollInterval) * time.Millisecond,
+		batchSize:      conf.Outbox.BatchSize,
+		maxAttempts:    conf.Outbox.MaxAttempts,
+		initialBackoff: time.Duration(conf.Outbox.InitialBackoff) * time.Millisecond,
+		maxBackoff:     time.Duration(conf.Outbox.MaxBackoff) * time.Millisecond,
+		claimTimeout:   time.Duration(conf.Outbox.ClaimTimeout) * time.Millisecond,
+	}
+	if r.pollInterval <= 0 {
+		r.pollInterval = defaultPollInterval
+	}
+	if r.batchSize <= 0 {
+		r.batchSize = defaultBatchSize
+	}
+	if r.maxAttempts <= 0 {
+		r.maxAttempts = defaultMaxAttempts
+	}
+	if r.initialBackoff <= 0 {
+		r.initialBackoff = defaultInitialBackoff
+	}
+	if r.maxBackoff <= 0 {
+		r.maxBackoff = defaultMaxBackoff
+	}
+	if r.claimTimeout <= 0 {
+		r.claimTimeout = defaultClaimTimeout
+	}
+	return r
+}
+
+// Run relays events until ctx is cancelled. Events claimed by a cancelled
+// batch are picked up again once their claim times out.
+func (r *Relay) Run(ctx context.Context) {
+	ticker := time.NewTicker(r.pollInterval)
+	defer ticker.Stop()
+
+	for {
+		delivered, err := r.relayBatch(ctx)
+		if err != nil && ctx.Err() == nil {
+			r.logger.Errorf("relay batch failed: %s", err)
+		}
+		// A full batch delivered without failures means there is likely
+		// more waiting; anything else waits for the next tick.
+		if err == nil && delivered == r.batchSize {
+			continue
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// relayBatch publishes one batch and returns how many events were delivered.
+func (r *Relay) relayBatch(ctx context.Context) (int, error) {
+	conn, err := r.postgres.GetWriteConnection(ctx)
+	if err != nil {
+		return 0, err
+	}
+	events, err := r.claim(ctx, conn)
+	if err != nil {
+		return 0, err
+	}
+
+	delivered := 0
+	for _, event := range events {
+		if err := r.publisher.Publish(ctx, event); err != nil {
+			if err := r.fail(ctx, conn, event, err); err != nil {
+				return delivered, err
+			}
+			continue
+		}
+		if _, err := conn.ExecContext(ctx,
+			`UPDATE `+Table+` SET delivered_at = now(), attempts = attempts + 1 WHERE id = $1`,
+			event.ID); err != nil {
+			return delivered, err
+		}
+		delivered++
+	}
+	return delivered, nil
+}
+
+// claim takes up to batchSize due events for claimTimeout in a single
+// statement, so no transaction stays open while they are published.
+func (r *Relay) claim(ctx context.Context, conn database.Conn) ([]Event, error) {
+	var events []Event
+	if err := conn.SelectContext(ctx, &events,
+		`UPDATE `+Table+` SET next_attempt_at = now() + $3::bigint * interval '1 millisecond'
+		WHERE id IN (
+			SELECT id FROM `+Table+`
+			WHERE delivered_at IS NULL AND attempts < $1 AND next_attempt_at <= now()
+			ORDER BY id
+			LIMIT $2
+			FOR UPDATE SKIP LOCKED
+		)
+		RETURNING id, topic, key, payload, created_at, attempts`,
+		r.maxAttempts, r.batchSize, r.claimTimeout.Milliseconds()); err != nil {
+		return nil, err
+	}
+	sort.Slice(events, func(i, j int) bool { return events[i].ID < events[j].ID })
+	return events, nil
+}
+
+func (r *Relay) fail(ctx context.Context, conn database.Conn, event Event, publishErr error) error {
+	attempts := event.Attempts + 1
+	if attempts >= r.maxAttempts {
+		r.logger.Errorf("publish event %d to %s failed, giving up after %d attempts: %s",
+			event.ID, event.Topic, attempts, publishErr)
+	} else {
+		r.logger.Warnf("publish event %d to %s failed (attempt %d/%d): %s",
+			event.ID, event.Topic, attempts, r.maxAttempts, publishErr)
+	}
+	_, err := conn.ExecContext(ctx,
+		`UPDATE `+Table+` SET attempts = attempts + 1, last_error = $2,
+			next_attempt_at = now() + $3::bigint * interval '1 millisecond'
+		WHERE id = $1`,
+		event.ID, publishErr.Error(), r.backoff(attempts).Milliseconds())
+	return err
+}
+
+// backoff is the wait before the attempt after the attempts-th failed one.
+func (r *Relay) backoff(attempts int) time.Duration {
+	d := r.initialBackoff << (attempts - 1)
+	if d <= 0 || d > r.maxBackoff {
+		d = r.maxBackoff
+	}
+	return d
+}
+
+// LogPublisher only logs events. It is the default until a real broker is
+// wired in.
+type LogPublisher struct {
+	logger log.Logger
+}
+
+func NewLogPublisher(logger log.Logger) *LogPublisher {
+	return &LogPublisher{logger: logger}
+}
+
+func (p *LogPublisher) Publish(ctx context.Context, event Event) error {
+	p.logger.WithFields(map[string]interface{}{
+		"id":    event.ID,
+		"topic": event.Topic,
+		"key":   event.Key,
+	}).Infof("outbox event: %s", event.Payload)
+	return nil
+}
@@ -19,10 +19,11 @@ type Config struct {
 		Debug bool
 	}
 	Server struct {
-		IP   string
-		Name string
-		Host string
-		Port string
+		IP        string
+		Name      string
+		Host      string
+		Port      string
+		AdminPort string
 	}
 
 	Connection struct {
@@ -30,25 +31,105 @@ type Config struct {
 			TimeOut int
 		}
 		Postgresql struct {
-			Master struct {
-				DB       string
-				Host     string
-				User     string
-				Password string
-				MaxOpen  int
-				MaxIdle  int
+			Driver             string
+			Master             PostgresqlInstance
+			Slave              PostgresqlInstance
+			Replicas           []PostgresqlInstance
+			FixedReadInstance  string
+			LoadBalancer       string
+			MaxReplicationLag  int
+			SlowQueryThreshold int
+			HealthCheck        struct {
+				Interval int
+				Timeout  int
 			}
-			Slave struct {
-				DB       string
-				Host     string
-				User     string
-				Password string
-				MaxOpen  int
-				MaxIdle  int
+			Retry struct {
+				MaxAttempts    int
+				InitialBackoff int
+				MaxBackoff     int
 			}
-			FixedReadInstance string
+			StartupRetry struct {
+				MaxAttempts    int
+				InitialBackoff int
+				MaxBackoff     int
+			}
+			CircuitBreaker struct {
+				FailureThreshold int
+				OpenTimeout      int
+				HalfOpenRequests int
+			}
+			StickyPrimary struct {
+				Window int
+				Cookie string
+				Header string
+				Secret string
+			}
+			SessionVariables SessionVariables
 		}
 	}
+
+	Outbox struct {
+		Enabled        bool
+		PollInterval   int
+		BatchSize      int
+		MaxAttempts    int
+		InitialBackoff int
+		MaxBackoff     int
+		ClaimTimeout   int
+	}
+
+	Tenancy struct {
+		Enabled        bool
+		Header         string
+		BaseDomain     string
+		AllowAnonymous bool
+		Required       bool
+		AllowUnlisted  bool
+		SchemaFormat   string
+		IdleTimeout    int
+		MaxOpen        int
+		MaxPools       int
+		Tenants        []TenantConfig
+	}
+}
+
+// SessionVariables names the Postgres settings request transactions get from
+// the JWT claims and the tenant. Empty names are not set.
+type SessionVariables struct {
+	UID       string
+	UserID    string
+	APPID     string
+	SessionID string
+	Tenant    string
+}
+
+type TenantConfig struct {
+	ID       string
+	Schema   string
+	Database PostgresqlInstance
+}
+
+type PostgresqlInstance struct {
+	Name           string
+	DSN            string
+	DB             string
+	Host           string
+	Port           string
+	User           string
+	Password       string
+	SSLMode        string
+	SSLRootCert    string
+	SSLCert        string
+	SSLKey         string
+	Params         map[string]string
+	SearchPath     string
+	MaxOpen        int
+	NativeMaxOpen  int
+	MaxIdle        int
+	MaxLifetime    int
+	MaxIdleTime    int
+	ConnectTimeout int
+	Weight         int
 }
 
 func NewConfig() (*Config, error) {
@@ -0,0 +1,38 @@
+package middleware
+
+import (
+	"github.com/gin-gonic/gin"
+	"go-starter-kit/internal/pkg/jwt"
+	"net/http"
+	"strings"
+)
+
+// Auth validates the bearer token of the request, when there is one, and
+// puts its claims in the request context for jwt.UserClaimsFromCtx. Requests
+// without a token pass through; an invalid token is answered with 401. It
+// must run before Tenant and Tx, which read the claims.
+func Auth(validator jwt.Validator) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		token, ok := bearerToken(c)
+		if !ok {
+			c.Next()
+			return
+		}
+		claims, err := validator.Validator(c.Request.Context(), token)
+		if err != nil {
+			_ = c.AbortWithError(http.StatusUnauthorized, err)
+			return
+		}
+		c.Request = c.Request.WithContext(jwt.WithUserClaims(c.Request.Context(), claims))
+		c.Next()
+	}
+}
+
+func bearerToken(c *gin.Context) (string, bool) {
+	const prefix = "Bearer "
+	header := c.GetHeader("Authorization")
+	if len(header) <= len(prefix) || !strings.EqualFold(header[:len(prefix)], prefix) {
+		return "", false
+	}
+	return strings.TrimSpace(header[len(prefix):]), true
+}
@@ -2,41 +2,97 @@ package middleware
 
 import (
 	"context"
+	"fmt"
 	"github.com/gin-gonic/gin"
 	"go-starter-kit/internal/log"
 	"go-starter-kit/internal/pkg/database"
+	"net/http"
 )
 
+// Tx gives every request a TransactionCtx. The transaction itself is opened
+// lazily by the first Postgres.GetWriteConnection and is committed right
+// before the response is sent when the handler succeeded, so a client never
+// sees a 2xx for data that was not persisted. Handler errors, 4xx/5xx
+// responses and panics roll it back.
 func Tx(logger log.Logger) gin.HandlerFunc {
 	return func(c *gin.Context) {
-		ctx := InitCtx(c.Request.Context())
+		ctx := database.WithRoute(InitCtx(c.Request.Context()), c.FullPath())
 		c.Request = c.Request.WithContext(ctx)
+
+		w := wrapBeforeWrite(c, func() bool {
+			reqErr := requestError(c)
+			if err := EndCtx(ctx, logger, reqErr); err != nil && reqErr == nil {
+				c.Status(http.StatusInternalServerError)
+				return false
+			}
+			return true
+		})
 		defer func() {
-			EndCtx(ctx, logger)
+			if r := recover(); r != nil {
+				_ = EndCtx(ctx, logger, fmt.Errorf("panic: %v", r))
+				panic(r)
+			}
 		}()
+
 		c.Next()
+
+		w.before()
+		if w.discard {
+			_, _ = w.ResponseWriter.WriteString(`{"error":"commit transaction failed"}`)
+		}
 	}
 }
 
 func InitCtx(ctx context.Context) context.Context {
-	return context.WithValue(ctx, database.TransactionCtxKey, database.TransactionCtx{})
+	return context.WithValue(ctx, database.TransactionCtxKey, &database.TransactionCtx{})
 }
 
-func EndCtx(ctx context.Context, logger log.Logger) {
-	if transactionCtx, ok := ctx.Value(database.TransactionCtxKey).(*database.TransactionCtx); ok {
-		if tx := transactionCtx.Conn; tx != nil {
-			if err := recover(); err != nil {
-				if err := tx.Rollback(); err != nil {
-					logger.Error("tx rollback failed: %s", err)
-				} else {
-					logger.Info("tx rollbacked")
-				}
-				panic(err)
-			} else {
-				if err = tx.Commit(); err != nil {
-					logger.Error("commit transaction failed: %s", err)
-				}
-			}
+// EndCtx commits the request transaction, or rolls it back when err is
+// non-nil, and runs the hooks registered on it. It is safe to call more than
+// once; only the first call has an effect.
+func EndCtx(ctx context.Context, logger log.Logger, err error) error {
+	transactionCtx, ok := ctx.Value(database.TransactionCtxKey).(*database.TransactionCtx)
+	if !ok || transactionCtx == nil {
+		return nil
+	}
+
+	active := transactionCtx.Active()
+	endErr := transactionCtx.End(ctx, err)
+	switch {
+	case endErr != nil && err != nil:
+		logger.Errorf("tx rollback failed: %s", endErr)
+	case endErr != nil:
+		logger.Errorf("commit transaction failed: %s", endErr)
+	case err != nil && active:
+		logger.Infof("tx rollbacked: %s", err)
+	}
+	return endErr
+}
+
+func requestError(c *gin.Context) error {
+	if err := c.Errors.Last(); err != nil {
+		return err
+	}
+	if status := c.Writer.Status(); status >= http.StatusBadRequest {
+		return fmt.Errorf("response status %d", status)
+	}
+	return nil
+}
+
+// TxOptions declares the options of the request transaction for a route or
+// group. It must run after Tx, e.g.
+//
+//	reports.Use(middleware.TxOptions(&database.TxOptions{
+//		Isolation:  sql.LevelSerializable,
+//		ReadOnly:   true,
+//		Deferrable: true,
+//	}))
+func TxOptions(opts *database.TxOptions) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if err := database.SetTxOptions(c.Request.Context(), opts); err != nil {
+			_ = c.AbortWithError(http.StatusInternalServerError, err)
+			return
 		}
+		c.Next()
 	}
 }
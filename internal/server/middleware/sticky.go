@@ -0,0 +1,128 @@
+package middleware
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"github.com/gin-gonic/gin"
+	"go-starter-kit/internal/pkg/database"
+	"go-starter-kit/internal/server/config"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// StickyPrimary keeps a client on master for a short window after one of its
+// requests wrote to the database. The deadline is handed back to the client
+// as a cookie and a response header; either one sent with a later request
+// routes that request's reads to master until the deadline passes.
+//
+// The deadline is signed with StickyPrimary.Secret, so a client cannot pin
+// itself to master by sending a deadline of its own. Without a secret each
+// process signs with a random key and a deadline only holds on the instance
+// that issued it.
+func StickyPrimary(cfg *config.Config) gin.HandlerFunc {
+	sticky := cfg.Connection.Postgresql.StickyPrimary
+	window := time.Duration(sticky.Window) * time.Second
+	key := []byte(sticky.Secret)
+	if len(key) == 0 {
+		key = make([]byte, sha256.Size)
+		_, _ = rand.Read(key)
+	}
+
+	return func(c *gin.Context) {
+		if window <= 0 {
+			c.Next()
+			return
+		}
+
+		if until, ok := stickyDeadline(c, sticky.Cookie, sticky.Header, key); ok && stickyActive(until, window) {
+			c.Request = c.Request.WithContext(withStickyPrimary(c.Request.Context()))
+		}
+
+		w := wrapBeforeWrite(c, func() bool {
+			if !wroteToPrimary(c.Request.Context()) {
+				return true
+			}
+			until := signStickyDeadline(time.Now().Add(window), key)
+			if sticky.Cookie != "" {
+				http.SetCookie(c.Writer, &http.Cookie{
+					Name:     sticky.Cookie,
+					Value:    until,
+					Path:     "/",
+					MaxAge:   int(window.Seconds()),
+					HttpOnly: true,
+					SameSite: http.SameSiteLaxMode,
+				})
+			}
+			if sticky.Header != "" {
+				c.Writer.Header().Set(sticky.Header, until)
+			}
+			return true
+		})
+		c.Next()
+		w.before()
+	}
+}
+
+// signStickyDeadline encodes until as unix seconds and their HMAC-SHA256
+// under key, "<unix>.<base64url mac>".
+func signStickyDeadline(until time.Time, key []byte) string {
+	unix := strconv.FormatInt(until.Unix(), 10)
+	return unix + "." + base64.RawURLEncoding.EncodeToString(stickyMAC(unix, key))
+}
+
+func stickyMAC(unix string, key []byte) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(unix))
+	return mac.Sum(nil)
+}
+
+// stickyDeadline returns the deadline sent in the header, or else the cookie,
+// when it carries a valid signature under key.
+func stickyDeadline(c *gin.Context, cookieName, headerName string, key []byte) (time.Time, bool) {
+	var raw string
+	if headerName != "" {
+		raw = c.GetHeader(headerName)
+	}
+	if raw == "" && cookieName != "" {
+		raw, _ = c.Cookie(cookieName)
+	}
+	unix, sig, ok := strings.Cut(raw, ".")
+	if !ok {
+		return time.Time{}, false
+	}
+	mac, err := base64.RawURLEncoding.DecodeString(sig)
+	if err != nil || !hmac.Equal(mac, stickyMAC(unix, key)) {
+		return time.Time{}, false
+	}
+	seconds, err := strconv.ParseInt(unix, 10, 64)
+	if err != nil {
+		return time.Time{}, false
+	}
+	return time.Unix(seconds, 0), true
+}
+
+// stickyActive reports whether until is still ahead but no further than
+// window, which holds for every deadline issued under the current window.
+func stickyActive(until time.Time, window time.Duration) bool {
+	now := time.Now()
+	return now.Before(until) && !until.After(now.Add(window))
+}
+
+func withStickyPrimary(ctx context.Context) context.Context {
+	var setting database.CustomSettingCtx
+	if current, ok := ctx.Value(database.CustomSettingCtxKey).(*database.CustomSettingCtx); ok && current != nil {
+		setting = *current
+	}
+	setting.StickyPrimary = true
+	return context.WithValue(ctx, database.CustomSettingCtxKey, &setting)
+}
+
+func wroteToPrimary(ctx context.Context) bool {
+	transactionCtx, ok := ctx.Value(database.TransactionCtxKey).(*database.TransactionCtx)
+	return ok && transactionCtx != nil && transactionCtx.Committed()
+}
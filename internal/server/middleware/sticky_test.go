@@ -0,0 +1,73 @@
+package middleware
+
+import (
+	"github.com/gin-gonic/gin"
+	"go-starter-kit/internal/pkg/database"
+	"go-starter-kit/internal/server/config"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestStickyPrimary(t *testing.T) {
+	key := []byte("secret")
+	now := time.Now()
+	tests := []struct {
+		name       string
+		window     int
+		header     string
+		cookie     string
+		wantSticky bool
+	}{
+		{name: "none", window: 5},
+		{name: "header", window: 5, header: signStickyDeadline(now.Add(5*time.Second), key), wantSticky: true},
+		{name: "cookie", window: 5, cookie: signStickyDeadline(now.Add(5*time.Second), key), wantSticky: true},
+		{name: "unsigned", window: 5, header: "99999999999"},
+		{name: "signed with another key", window: 5, header: signStickyDeadline(now.Add(5*time.Second), []byte("other"))},
+		{name: "bad signature", window: 5, header: "99999999999.not-base64!"},
+		{name: "expired", window: 5, header: signStickyDeadline(now.Add(-time.Second), key)},
+		{name: "beyond the window", window: 5, header: signStickyDeadline(now.Add(time.Hour), key)},
+		{name: "disabled", header: signStickyDeadline(now.Add(5*time.Second), key)},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := &config.Config{}
+			sticky := &cfg.Connection.Postgresql.StickyPrimary
+			sticky.Window = tt.window
+			sticky.Cookie = "pg_sticky_primary"
+			sticky.Header = "X-Sticky-Primary-Until"
+			sticky.Secret = string(key)
+
+			var gotSticky bool
+			gin.SetMode(gin.TestMode)
+			router := gin.New()
+			router.Use(StickyPrimary(cfg))
+			router.GET("/", func(c *gin.Context) {
+				setting, ok := c.Request.Context().Value(database.CustomSettingCtxKey).(*database.CustomSettingCtx)
+				gotSticky = ok && setting.StickyPrimary
+				c.Status(http.StatusOK)
+			})
+
+			req := httptest.NewRequest(http.MethodGet, "/", nil)
+			if tt.header != "" {
+				req.Header.Set(sticky.Header, tt.header)
+			}
+			if tt.cookie != "" {
+				req.AddCookie(&http.Cookie{Name: sticky.Cookie, Value: tt.cookie})
+			}
+			w := httptest.NewRecorder()
+			router.ServeHTTP(w, req)
+
+			if w.Code != http.StatusOK {
+				t.Fatalf("status = %d, want %d", w.Code, http.StatusOK)
+			}
+			if gotSticky != tt.wantSticky {
+				t.Errorf("sticky = %v, want %v", gotSticky, tt.wantSticky)
+			}
+			if w.Header().Get(sticky.Header) != "" {
+				t.Error("deadline issued for a request that did not write")
+			}
+		})
+	}
+}
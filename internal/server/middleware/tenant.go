@@ -0,0 +1,96 @@
+package middleware
+
+import (
+	"fmt"
+	"github.com/gin-gonic/gin"
+	"go-starter-kit/internal/pkg/database"
+	"go-starter-kit/internal/pkg/jwt"
+	"go-starter-kit/internal/server/config"
+	"net"
+	"net/http"
+	"strings"
+)
+
+// Tenant resolves the tenant of the request and routes its database calls to
+// that tenant's pools or schema. It must run after Auth and before Tx.
+//
+// The tenant of an authenticated request is the APPID claim put in the
+// context by Auth. The Tenancy.Header header and the subdomain of
+// Tenancy.BaseDomain may name the tenant too, but a request naming another
+// tenant than its token is rejected with 403. A request without a token may
+// only pick a tenant by header or subdomain when Tenancy.AllowAnonymous is
+// set; such a tenant is not verified, so session variables are not set from
+// it. Otherwise it is rejected with 401.
+func Tenant(cfg *config.Config) gin.HandlerFunc {
+	tenancy := cfg.Tenancy
+	baseDomain := "." + strings.TrimPrefix(strings.ToLower(tenancy.BaseDomain), ".")
+
+	return func(c *gin.Context) {
+		if !tenancy.Enabled {
+			c.Next()
+			return
+		}
+
+		tenant, verified, status, err := resolveTenant(c, tenancy.Header, baseDomain, tenancy.AllowAnonymous)
+		switch {
+		case err != nil:
+			_ = c.AbortWithError(status, err)
+			return
+		case tenant == "" && tenancy.Required:
+			_ = c.AbortWithError(http.StatusBadRequest, fmt.Errorf("tenant is required"))
+			return
+		case tenant == "":
+			c.Next()
+			return
+		case !database.ValidTenantID(tenant):
+			_ = c.AbortWithError(http.StatusBadRequest, fmt.Errorf("%w %q", database.ErrInvalidTenant, tenant))
+			return
+		}
+
+		ctx := c.Request.Context()
+		if verified {
+			ctx = database.WithVerifiedTenant(ctx, tenant)
+		} else {
+			ctx = database.WithTenant(ctx, tenant)
+		}
+		c.Request = c.Request.WithContext(ctx)
+		c.Next()
+	}
+}
+
+// resolveTenant returns the tenant of the request and whether it comes from
+// validated claims, or the status to reject the request with.
+func resolveTenant(c *gin.Context, header, baseDomain string, allowAnonymous bool) (string, bool, int, error) {
+	requested := requestedTenant(c, header, baseDomain)
+	if claims, ok := jwt.UserClaimsFromCtx(c.Request.Context()); ok {
+		if requested != "" && requested != claims.APPID {
+			return "", false, http.StatusForbidden, fmt.Errorf("tenant %q does not match the token", requested)
+		}
+		return claims.APPID, claims.APPID != "", 0, nil
+	}
+	if requested != "" && !allowAnonymous {
+		return "", false, http.StatusUnauthorized, fmt.Errorf("tenant %q needs an authenticated request", requested)
+	}
+	return requested, false, 0, nil
+}
+
+// requestedTenant is the tenant named by the header, or else by the
+// subdomain of baseDomain.
+func requestedTenant(c *gin.Context, header, baseDomain string) string {
+	if header != "" {
+		if tenant := c.GetHeader(header); tenant != "" {
+			return tenant
+		}
+	}
+	if baseDomain != "." {
+		host := c.Request.Host
+		if h, _, err := net.SplitHostPort(host); err == nil {
+			host = h
+		}
+		host = strings.ToLower(host)
+		if sub := strings.TrimSuffix(host, baseDomain); sub != host && sub != "" && !strings.Contains(sub, ".") {
+			return sub
+		}
+	}
+	return ""
+}
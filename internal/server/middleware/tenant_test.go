@@ -0,0 +1,100 @@
+package middleware
+
+import (
+	"github.com/gin-gonic/gin"
+	"go-starter-kit/internal/pkg/database"
+	"go-starter-kit/internal/pkg/jwt"
+	"go-starter-kit/internal/server/config"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestTenant(t *testing.T) {
+	tests := []struct {
+		name           string
+		appID          string // APPID claim; no claims when empty
+		header         string
+		host           string
+		allowAnonymous bool
+		required       bool
+		wantStatus     int
+		wantTenant     string
+		wantVerified   bool
+	}{
+		{name: "from claims", appID: "acme", wantStatus: http.StatusOK, wantTenant: "acme", wantVerified: true},
+		{name: "header matches claims", appID: "acme", header: "acme", wantStatus: http.StatusOK, wantTenant: "acme", wantVerified: true},
+		{name: "subdomain matches claims", appID: "acme", host: "acme.example.com", wantStatus: http.StatusOK, wantTenant: "acme", wantVerified: true},
+		{name: "header names another tenant", appID: "acme", header: "evil", wantStatus: http.StatusForbidden},
+		{name: "subdomain names another tenant", appID: "acme", host: "evil.example.com:8080", wantStatus: http.StatusForbidden},
+		{name: "anonymous not allowed", header: "acme", wantStatus: http.StatusUnauthorized},
+		{name: "anonymous header", header: "acme", allowAnonymous: true, wantStatus: http.StatusOK, wantTenant: "acme"},
+		{name: "anonymous subdomain", host: "Acme.Example.com:8080", allowAnonymous: true, wantStatus: http.StatusOK, wantTenant: "acme"},
+		{name: "header wins over subdomain", header: "beta", host: "acme.example.com", allowAnonymous: true, wantStatus: http.StatusOK, wantTenant: "beta"},
+		{name: "nested subdomain ignored", host: "a.b.example.com", allowAnonymous: true, wantStatus: http.StatusOK},
+		{name: "other domain ignored", host: "acme.example.org", allowAnonymous: true, wantStatus: http.StatusOK},
+		{name: "invalid id", header: "../acme", allowAnonymous: true, wantStatus: http.StatusBadRequest},
+		{name: "required", required: true, wantStatus: http.StatusBadRequest},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := &config.Config{}
+			cfg.Tenancy.Enabled = true
+			cfg.Tenancy.Header = "X-Tenant"
+			cfg.Tenancy.BaseDomain = "example.com"
+			cfg.Tenancy.AllowAnonymous = tt.allowAnonymous
+			cfg.Tenancy.Required = tt.required
+
+			var gotTenant string
+			var gotVerified bool
+			gin.SetMode(gin.TestMode)
+			router := gin.New()
+			router.Use(Tenant(cfg))
+			router.GET("/", func(c *gin.Context) {
+				gotTenant, _ = database.TenantFromCtx(c.Request.Context())
+				_, gotVerified = database.VerifiedTenantFromCtx(c.Request.Context())
+				c.Status(http.StatusOK)
+			})
+
+			req := httptest.NewRequest(http.MethodGet, "/", nil)
+			if tt.host != "" {
+				req.Host = tt.host
+			}
+			if tt.header != "" {
+				req.Header.Set("X-Tenant", tt.header)
+			}
+			if tt.appID != "" {
+				req = req.WithContext(jwt.WithUserClaims(req.Context(), &jwt.UserClaims{APPID: tt.appID}))
+			}
+			w := httptest.NewRecorder()
+			router.ServeHTTP(w, req)
+
+			if w.Code != tt.wantStatus {
+				t.Fatalf("status = %d, want %d", w.Code, tt.wantStatus)
+			}
+			if gotTenant != tt.wantTenant || gotVerified != tt.wantVerified {
+				t.Errorf("tenant = %q (verified %v), want %q (verified %v)",
+					gotTenant, gotVerified, tt.wantTenant, tt.wantVerified)
+			}
+		})
+	}
+}
+
+func TestTenantDisabled(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	router := gin.New()
+	router.Use(Tenant(&config.Config{}))
+	router.GET("/", func(c *gin.Context) {
+		if tenant, ok := database.TenantFromCtx(c.Request.Context()); ok {
+			t.Errorf("tenant %q set while tenancy is disabled", tenant)
+		}
+		c.Status(http.StatusOK)
+	})
+	req := httptest.NewRequest(http.MethodGet, "/", nil)
+	req.Header.Set("X-Tenant", "acme")
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+	if w.Code != http.StatusOK {
+		t.Errorf("status = %d, want %d", w.Code, http.StatusOK)
+	}
+}
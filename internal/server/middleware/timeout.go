@@ -0,0 +1,26 @@
+package middleware
+
+import (
+	"context"
+	"github.com/gin-gonic/gin"
+	"go-starter-kit/internal/server/config"
+	"time"
+)
+
+// Timeout gives every request a deadline of Connection.HTTP.TimeOut seconds.
+// Database calls made with c.Request.Context() inherit it, so a slow query is
+// cancelled in Postgres once the deadline passes or the client goes away.
+func Timeout(cfg *config.Config) gin.HandlerFunc {
+	timeout := time.Duration(cfg.Connection.HTTP.TimeOut) * time.Second
+
+	return func(c *gin.Context) {
+		if timeout <= 0 {
+			c.Next()
+			return
+		}
+		ctx, cancel := context.WithTimeout(c.Request.Context(), timeout)
+		defer cancel()
+		c.Request = c.Request.WithContext(ctx)
+		c.Next()
+	}
+}
@@ -0,0 +1,62 @@
+package middleware
+
+import (
+	"bufio"
+	"github.com/gin-gonic/gin"
+	"net"
+	"sync"
+)
+
+// beforeWriteWriter runs fn exactly once, right before the response status
+// and headers are sent, so middlewares can still change them after the
+// handler decided what to respond with. When fn returns false the body the
+// handler writes is discarded.
+type beforeWriteWriter struct {
+	gin.ResponseWriter
+	once    sync.Once
+	fn      func() bool
+	discard bool
+}
+
+func wrapBeforeWrite(c *gin.Context, fn func() bool) *beforeWriteWriter {
+	w := &beforeWriteWriter{ResponseWriter: c.Writer, fn: fn}
+	c.Writer = w
+	return w
+}
+
+func (w *beforeWriteWriter) before() {
+	w.once.Do(func() {
+		w.discard = !w.fn()
+	})
+}
+
+func (w *beforeWriteWriter) Write(data []byte) (int, error) {
+	w.before()
+	if w.discard {
+		return len(data), nil
+	}
+	return w.ResponseWriter.Write(data)
+}
+
+func (w *beforeWriteWriter) WriteString(s string) (int, error) {
+	w.before()
+	if w.discard {
+		return len(s), nil
+	}
+	return w.ResponseWriter.WriteString(s)
+}
+
+func (w *beforeWriteWriter) WriteHeaderNow() {
+	w.before()
+	w.ResponseWriter.WriteHeaderNow()
+}
+
+func (w *beforeWriteWriter) Flush() {
+	w.before()
+	w.ResponseWriter.Flush()
+}
+
+func (w *beforeWriteWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	w.before()
+	return w.ResponseWriter.Hijack()
+}
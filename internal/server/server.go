@@ -4,14 +4,18 @@ import (
 	"context"
 	"fmt"
 	"github.com/gin-gonic/gin"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
 	"go-starter-kit/internal/log"
 	"go-starter-kit/internal/pkg/database"
+	"go-starter-kit/internal/pkg/jwt"
+	"go-starter-kit/internal/pkg/outbox"
 	"go-starter-kit/internal/server/config"
 	"go-starter-kit/internal/server/middleware"
 	"golang.org/x/sync/errgroup"
 	"net/http"
 	"os"
 	"os/signal"
+	"sync"
 	"syscall"
 	"time"
 )
@@ -21,12 +25,16 @@ type Server struct {
 	config     *config.Config
 	httpServer *gin.Engine
 	postgres   *database.Postgres
+	relay      *outbox.Relay
+
+	adminServer *gin.Engine
 }
 
 func NewServer(config *config.Config,
 	logger log.Logger,
 	httpServer *gin.Engine,
-	postgres *database.Postgres) *Server {
+	postgres *database.Postgres,
+	relay *outbox.Relay) *Server {
 
 	{
 		httpServer.GET("/healthz", func(c *gin.Context) {
@@ -38,24 +46,49 @@ func NewServer(config *config.Config,
 			defer cancel()
 
 			g, ctx := errgroup.WithContext(ctx)
-			g.Go(postgres.Ping)
+			g.Go(func() error {
+				return postgres.Ping(ctx)
+			})
 
 			if err := g.Wait(); err != nil {
-				c.Status(http.StatusInternalServerError)
+				c.JSON(http.StatusInternalServerError, gin.H{
+					"error":    err.Error(),
+					"postgres": postgres.Status(),
+				})
 				return
 			}
-			c.Status(http.StatusOK)
+			c.JSON(http.StatusOK, gin.H{"postgres": postgres.Status()})
 		})
 	}
 
+	var adminServer *gin.Engine
+	if config.Server.AdminPort != "" {
+		adminServer = NewAdminServer(postgres)
+	}
+
 	return &Server{
-		logger:     logger,
-		config:     config,
-		httpServer: httpServer,
-		postgres:   postgres,
+		logger:      logger,
+		config:      config,
+		httpServer:  httpServer,
+		postgres:    postgres,
+		relay:       relay,
+		adminServer: adminServer,
 	}
 }
 
+// NewAdminServer serves operational endpoints on a separate port that is not
+// meant to be exposed publicly.
+func NewAdminServer(postgres *database.Postgres) *gin.Engine {
+	engine := gin.New()
+	engine.Use(gin.Recovery())
+
+	engine.GET("/admin/postgres/stats", func(c *gin.Context) {
+		c.JSON(http.StatusOK, postgres.Stats())
+	})
+	engine.GET("/metrics", gin.WrapH(promhttp.Handler()))
+	return engine
+}
+
 func (s *Server) Run() {
 	sigint := make(chan os.Signal, 1)
 
@@ -71,6 +104,31 @@ func (s *Server) Run() {
 		}
 	}()
 
+	var adminSrv *http.Server
+	if s.adminServer != nil {
+		adminSrv = &http.Server{
+			Addr:              fmt.Sprintf(":%v", s.config.Server.AdminPort),
+			ReadHeaderTimeout: 3 * time.Second,
+			Handler:           s.adminServer,
+		}
+		go func() {
+			s.logger.Infof("Admin server is running on port: %v", s.config.Server.AdminPort)
+			if err := adminSrv.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+				s.logger.Error("admin server is running error")
+			}
+		}()
+	}
+
+	workerCtx, stopWorkers := context.WithCancel(context.Background())
+	var workers sync.WaitGroup
+	if s.relay != nil {
+		workers.Add(1)
+		go func() {
+			defer workers.Done()
+			s.relay.Run(workerCtx)
+		}()
+	}
+
 	signal.Notify(sigint, os.Interrupt, syscall.SIGTERM)
 	<-sigint
 	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
@@ -79,14 +137,25 @@ func (s *Server) Run() {
 	if err := srv.Shutdown(ctx); err != nil {
 		s.logger.Error("Server forced to shutdown")
 	}
+	if adminSrv != nil {
+		if err := adminSrv.Shutdown(ctx); err != nil {
+			s.logger.Error("Admin server forced to shutdown")
+		}
+	}
+	stopWorkers()
+	workers.Wait()
 	s.postgres.Shutdown()
 
 	s.logger.Info("Server exiting")
 }
 
+// NewHTTPServer builds the engine with the middleware chain every route runs.
+// With a validator the claims of the request are known to Tenant and to the
+// session variables of its transaction, so Auth comes first.
 func NewHTTPServer(
 	logger log.Logger,
-	cfg *config.Config) *gin.Engine {
+	cfg *config.Config,
+	validator jwt.Validator) *gin.Engine {
 	var engine *gin.Engine
 	if cfg.Gim.Debug {
 		engine = gin.Default()
@@ -95,7 +164,13 @@ func NewHTTPServer(
 		engine = gin.New()
 	}
 
-	engine.Use(corsMiddleware, middleware.Cors(), middleware.Gzip(), middleware.Tx(logger))
+	engine.Use(corsMiddleware, middleware.Cors(), middleware.Gzip(), middleware.Timeout(cfg), middleware.StickyPrimary(cfg))
+	if validator != nil {
+		engine.Use(middleware.Auth(validator))
+	} else if cfg.Tenancy.Enabled && !cfg.Tenancy.AllowAnonymous {
+		logger.Warnf("tenancy is enabled without a token validator: requests naming a tenant will be rejected")
+	}
+	engine.Use(middleware.Tenant(cfg), middleware.Tx(logger))
 	return engine
 }
 
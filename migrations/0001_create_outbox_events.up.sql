@@ -0,0 +1,12 @@
+CREATE TABLE IF NOT EXISTS outbox_events (
+	id           BIGSERIAL PRIMARY KEY,
+	topic        TEXT        NOT NULL,
+	key          TEXT        NOT NULL DEFAULT '',
+	payload      JSONB       NOT NULL,
+	created_at   TIMESTAMPTZ NOT NULL DEFAULT now(),
+	delivered_at TIMESTAMPTZ,
+	attempts     INT         NOT NULL DEFAULT 0,
+	last_error   TEXT
+);
+
+CREATE INDEX IF NOT EXISTS outbox_events_pending_idx ON outbox_events (id) WHERE delivered_at IS NULL;
@@ -0,0 +1,4 @@
+DROP INDEX IF EXISTS outbox_events_pending_idx;
+CREATE INDEX IF NOT EXISTS outbox_events_pending_idx ON outbox_events (id) WHERE delivered_at IS NULL;
+
+ALTER TABLE outbox_events DROP COLUMN IF EXISTS next_attempt_at;